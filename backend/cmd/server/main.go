@@ -1,44 +1,124 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
+	"os/signal"
+	"portal/internal/bus"
 	"portal/internal/config"
 	"portal/internal/db"
 	"portal/internal/server"
-
-	"github.com/joho/godotenv"
+	"portal/internal/turn"
+	"syscall"
 )
 
 func main() {
-	if err := godotenv.Load(); err != nil {
-		log.Fatal("Error loading .env file")
+	// Load config
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatal("Error loading config:", err)
 	}
 
 	// Initialize database
-	database, err := db.NewDatabase(os.Getenv("DATABASE_URL"))
+	database, err := db.NewDatabase(cfg.DatabaseURL)
 	if err != nil {
 		log.Fatal("Error connecting to database:", err)
 	}
 
-	// Initialize tables
-	if err := database.InitializeTables(); err != nil {
-		log.Fatal("Error initializing tables:", err)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate":
+			if err := runMigrate(database, os.Args[2:]); err != nil {
+				log.Fatal("Error running migrations:", err)
+			}
+			return
+		default:
+			log.Fatalf("Unknown command %q", os.Args[1])
+		}
 	}
 
-	// Create config
-	cfg := &config.Config{
-		ServerAddress: os.Getenv("SERVER_ADDRESS"),
+	// Apply pending migrations
+	applied, err := database.MigrateUp()
+	if err != nil {
+		log.Fatal("Error applying migrations:", err)
 	}
-	if cfg.ServerAddress == "" {
-		cfg.ServerAddress = ":8080"
+	if applied > 0 {
+		log.Printf("Applied %d migration(s)", applied)
+	}
+
+	// Hash room passwords stored in plaintext before passwords were hashed
+	hashed, err := db.NewPostgresRoomStore(database).HashLegacyPasswords(cfg.PasswordCost)
+	if err != nil {
+		log.Fatal("Error hashing plaintext room passwords:", err)
+	}
+	if hashed > 0 {
+		log.Printf("Hashed %d plaintext room password(s)", hashed)
+	}
+
+	// Start the embedded TURN/STUN server if enabled
+	var turnServer *turn.Server
+	if cfg.TURNEnabled {
+		turnServer, err = turn.Start(cfg, db.NewPostgresUserStore(database))
+		if err != nil {
+			log.Fatal("Error starting TURN server:", err)
+		}
+		log.Printf("TURN server listening on UDP %d, TCP %d", cfg.TURNUDPPort, cfg.TURNTCPPort)
+	}
+
+	// Room events reach the other instances over the cluster bus
+	var events bus.Bus
+	if cfg.ClusterBus == config.ClusterBusPostgres {
+		events, err = db.NewPostgresBus(database, cfg.DatabaseURL)
+		if err != nil {
+			log.Fatal("Error starting cluster bus:", err)
+		}
+	} else {
+		events = bus.NewLocal()
 	}
 
 	// Initialize server
-	s := server.NewServer(cfg, database)
+	s, err := server.NewServer(cfg, database, events)
+	if err != nil {
+		log.Fatal("Error initializing server:", err)
+	}
 
 	log.Printf("Server starting on %s", cfg.ServerAddress)
-	if err := s.Start(); err != nil {
+	if cfg.MetricsAddress != "" {
+		log.Printf("Metrics served on %s", cfg.MetricsAddress)
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- s.Start()
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-serveErr:
 		log.Fatal("Error starting server:", err)
+	case sig := <-stop:
+		log.Printf("Received %s, draining connections for up to %s", sig, cfg.ShutdownDrainPeriod)
+	}
+	// A second signal kills the process straight away
+	signal.Stop(stop)
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownDrainPeriod)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		log.Printf("error shutting down server: %v", err)
+	}
+
+	if err := events.Close(); err != nil {
+		log.Printf("error closing cluster bus: %v", err)
+	}
+	if turnServer != nil {
+		if err := turnServer.Close(); err != nil {
+			log.Printf("error closing TURN server: %v", err)
+		}
+	}
+	if err := database.Close(); err != nil {
+		log.Printf("error closing database: %v", err)
 	}
+	log.Printf("Server stopped")
 }
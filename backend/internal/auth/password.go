@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// MaxPasswordLength is the longest password bcrypt can hash without
+// silently ignoring the remainder.
+const MaxPasswordLength = 72
+
+var ErrPasswordTooLong = errors.New("password too long")
+
+// HashPassword hashes a room password with bcrypt at the given cost. An
+// empty password hashes to an empty string, meaning no password is set.
+func HashPassword(password string, cost int) (string, error) {
+	if password == "" {
+		return "", nil
+	}
+	if len(password) > MaxPasswordLength {
+		return "", ErrPasswordTooLong
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// IsHash reports whether hash came from HashPassword, as opposed to a
+// plaintext password stored before passwords were hashed.
+func IsHash(hash string) bool {
+	_, err := bcrypt.Cost([]byte(hash))
+	return err == nil
+}
+
+// VerifyPassword checks password against a hash from HashPassword in
+// constant time. needsRehash reports that the hash was made with a
+// different cost and should be replaced now that the password is known.
+// Anything that is not a hash matches no password; plaintext passwords
+// left from before hashing are hashed at startup instead.
+func VerifyPassword(hash, password string, cost int) (ok bool, needsRehash bool) {
+	if hash == "" {
+		return password == "", false
+	}
+
+	hashCost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		return false, false
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return false, false
+	}
+	return true, hashCost != cost
+}
@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHashPassword(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		empty    bool
+		err      error
+	}{
+		{name: "no password", password: "", empty: true},
+		{name: "password", password: "hunter2"},
+		{name: "longest", password: strings.Repeat("a", MaxPasswordLength)},
+		{name: "too long", password: strings.Repeat("a", MaxPasswordLength+1), err: ErrPasswordTooLong},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hash, err := HashPassword(tt.password, bcrypt.MinCost)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if (hash == "") != tt.empty {
+				t.Fatalf("hash = %q, want empty: %v", hash, tt.empty)
+			}
+			if hash == tt.password && !tt.empty {
+				t.Fatal("password stored as plaintext")
+			}
+		})
+	}
+}
+
+func TestVerifyPassword(t *testing.T) {
+	const cost = bcrypt.MinCost
+	hash, err := HashPassword("hunter2", cost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stronger, err := HashPassword("hunter2", cost+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		hash        string
+		password    string
+		ok          bool
+		needsRehash bool
+	}{
+		{name: "correct", hash: hash, password: "hunter2", ok: true},
+		{name: "wrong", hash: hash, password: "hunter3"},
+		{name: "empty against hash", hash: hash, password: ""},
+		{name: "other cost", hash: stronger, password: "hunter2", ok: true, needsRehash: true},
+		{name: "wrong at other cost", hash: stronger, password: "hunter3"},
+		{name: "no password set", hash: "", password: "", ok: true},
+		{name: "password sent when none set", hash: "", password: "hunter2"},
+		{name: "legacy plaintext is never accepted", hash: "hunter2", password: "hunter2"},
+		{name: "wrong legacy plaintext", hash: "hunter2", password: "hunter3"},
+		{name: "hash sent as password", hash: hash, password: hash},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, needsRehash := VerifyPassword(tt.hash, tt.password, cost)
+			if ok != tt.ok || needsRehash != tt.needsRehash {
+				t.Errorf("VerifyPassword() = %v, %v, want %v, %v", ok, needsRehash, tt.ok, tt.needsRehash)
+			}
+		})
+	}
+}
+
+func TestIsHash(t *testing.T) {
+	hash, err := HashPassword("hunter2", bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		hash string
+		want bool
+	}{
+		{name: "bcrypt", hash: hash, want: true},
+		{name: "empty", hash: ""},
+		{name: "plaintext", hash: "hunter2"},
+		{name: "plaintext that looks like a prefix", hash: "$2a$10$short"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsHash(tt.hash); got != tt.want {
+				t.Errorf("IsHash(%q) = %v, want %v", tt.hash, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrExpiredToken = errors.New("token expired")
+)
+
+const (
+	PurposeSession = "session"
+	PurposeInvite  = "invite"
+)
+
+// MinSecretLength is the shortest signing secret NewKeyring accepts, which
+// also rules out placeholders like change-me.
+const MinSecretLength = 16
+
+// Claims is the signed body of a token.
+type Claims struct {
+	Subject   string `json:"sub"`
+	Purpose   string `json:"pur"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	RoomID    string `json:"rid,omitempty"`
+}
+
+// Keyring signs and verifies tokens with HMAC-SHA256. The first key signs
+// new tokens; the others are only accepted for verification, so a key can
+// be rotated out once every token it signed has expired.
+type Keyring struct {
+	activeID string
+	keys     map[string][]byte
+}
+
+// NewKeyring parses a comma-separated list of id:secret pairs.
+func NewKeyring(spec string) (*Keyring, error) {
+	k := &Keyring{keys: make(map[string][]byte)}
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		id, secret, ok := strings.Cut(entry, ":")
+		if !ok || id == "" || secret == "" || strings.Contains(id, ".") {
+			return nil, fmt.Errorf("invalid key entry %q, expected id:secret", entry)
+		}
+		if len(secret) < MinSecretLength {
+			return nil, fmt.Errorf("secret for key %q is too short, use at least %d characters", id, MinSecretLength)
+		}
+		if _, exists := k.keys[id]; exists {
+			return nil, fmt.Errorf("duplicate key id %q", id)
+		}
+
+		k.keys[id] = []byte(secret)
+		if k.activeID == "" {
+			k.activeID = id
+		}
+	}
+
+	if k.activeID == "" {
+		return nil, errors.New("no signing keys configured")
+	}
+	return k, nil
+}
+
+// NewRandomKeyring returns a keyring with a single random key. Tokens it
+// signs do not survive a restart.
+func NewRandomKeyring() (*Keyring, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return NewKeyring("ephemeral:" + hex.EncodeToString(secret))
+}
+
+// Issue signs a token for subject that expires after ttl.
+func (k *Keyring) Issue(subject, purpose string, ttl time.Duration) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(ttl)
+	token, err := k.Sign(Claims{
+		Subject:   subject,
+		Purpose:   purpose,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: expiresAt.Unix(),
+	})
+	return token, expiresAt, err
+}
+
+// Sign encodes claims as kid.payload.signature.
+func (k *Keyring) Sign(claims Claims) (string, error) {
+	body, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed := k.activeID + "." + base64.RawURLEncoding.EncodeToString(body)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(k.mac(k.keys[k.activeID], signed)), nil
+}
+
+// Verify checks the signature, expiry and purpose of a token and returns
+// its claims.
+func (k *Keyring) Verify(token, purpose string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	key, exists := k.keys[parts[0]]
+	if !exists {
+		return nil, ErrInvalidToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	if !hmac.Equal(signature, k.mac(key, parts[0]+"."+parts[1])) {
+		return nil, ErrInvalidToken
+	}
+
+	body, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	var claims Claims
+	if err := json.Unmarshal(body, &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if claims.Purpose != purpose || claims.Subject == "" {
+		return nil, ErrInvalidToken
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return nil, ErrExpiredToken
+	}
+	return &claims, nil
+}
+
+func (k *Keyring) mac(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
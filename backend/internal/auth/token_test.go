@@ -0,0 +1,195 @@
+package auth
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	oldSecret = "old-secret-0123456789"
+	newSecret = "new-secret-0123456789"
+)
+
+func mustKeyring(t *testing.T, spec string) *Keyring {
+	t.Helper()
+	k, err := NewKeyring(spec)
+	if err != nil {
+		t.Fatalf("NewKeyring(%q): %v", spec, err)
+	}
+	return k
+}
+
+func TestNewKeyring(t *testing.T) {
+	tests := []struct {
+		name     string
+		spec     string
+		activeID string
+		err      string
+	}{
+		{name: "single key", spec: "main:" + newSecret, activeID: "main"},
+		{name: "first key signs", spec: "new:" + newSecret + ",old:" + oldSecret, activeID: "new"},
+		{name: "spaces and empty entries", spec: " new:" + newSecret + " ,, old:" + oldSecret, activeID: "new"},
+		{name: "empty", spec: "", err: "no signing keys"},
+		{name: "only commas", spec: ",,", err: "no signing keys"},
+		{name: "missing secret", spec: "main:", err: "expected id:secret"},
+		{name: "missing id", spec: ":" + newSecret, err: "expected id:secret"},
+		{name: "no separator", spec: newSecret, err: "expected id:secret"},
+		{name: "dot in id", spec: "ma.in:" + newSecret, err: "expected id:secret"},
+		{name: "duplicate id", spec: "main:" + newSecret + ",main:" + oldSecret, err: "duplicate key id"},
+		{name: "placeholder secret", spec: "main:change-me", err: "too short"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k, err := NewKeyring(tt.spec)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("err = %v, want it to contain %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if k.activeID != tt.activeID {
+				t.Errorf("activeID = %q, want %q", k.activeID, tt.activeID)
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	keys := mustKeyring(t, "main:"+newSecret)
+	now := time.Now().Unix()
+
+	sign := func(claims Claims) string {
+		token, err := keys.Sign(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	valid := sign(Claims{Subject: "alice", Purpose: PurposeSession, IssuedAt: now, ExpiresAt: now + 60})
+	parts := strings.Split(valid, ".")
+
+	forged, err := mustKeyring(t, "main:"+oldSecret).Sign(Claims{Subject: "alice", Purpose: PurposeSession, ExpiresAt: now + 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherBody := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"mallory","pur":"session","exp":` + "99999999999" + `}`))
+
+	tests := []struct {
+		name    string
+		token   string
+		purpose string
+		subject string
+		err     error
+	}{
+		{name: "valid", token: valid, purpose: PurposeSession, subject: "alice"},
+		{name: "wrong purpose", token: valid, purpose: PurposeInvite, err: ErrInvalidToken},
+		{name: "expired", token: sign(Claims{Subject: "alice", Purpose: PurposeSession, ExpiresAt: now - 1}), purpose: PurposeSession, err: ErrExpiredToken},
+		{name: "expires now", token: sign(Claims{Subject: "alice", Purpose: PurposeSession, ExpiresAt: now}), purpose: PurposeSession, err: ErrExpiredToken},
+		{name: "no subject", token: sign(Claims{Purpose: PurposeSession, ExpiresAt: now + 60}), purpose: PurposeSession, err: ErrInvalidToken},
+		{name: "signed by another secret", token: forged, purpose: PurposeSession, err: ErrInvalidToken},
+		{name: "swapped body", token: parts[0] + "." + otherBody + "." + parts[2], purpose: PurposeSession, err: ErrInvalidToken},
+		{name: "unknown key id", token: "other." + parts[1] + "." + parts[2], purpose: PurposeSession, err: ErrInvalidToken},
+		{name: "bad signature encoding", token: parts[0] + "." + parts[1] + ".!!", purpose: PurposeSession, err: ErrInvalidToken},
+		{name: "missing signature", token: parts[0] + "." + parts[1], purpose: PurposeSession, err: ErrInvalidToken},
+		{name: "extra part", token: valid + ".x", purpose: PurposeSession, err: ErrInvalidToken},
+		{name: "empty", token: "", purpose: PurposeSession, err: ErrInvalidToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := keys.Verify(tt.token, tt.purpose)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if err == nil && claims.Subject != tt.subject {
+				t.Errorf("Subject = %q, want %q", claims.Subject, tt.subject)
+			}
+		})
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	before := mustKeyring(t, "old:"+oldSecret)
+	during := mustKeyring(t, "new:"+newSecret+",old:"+oldSecret)
+	after := mustKeyring(t, "new:"+newSecret)
+
+	oldToken, _, err := before.Issue("alice", PurposeSession, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newToken, _, err := during.Issue("alice", PurposeSession, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(newToken, "new.") {
+		t.Fatalf("token %q is not signed by the first key", newToken)
+	}
+
+	tests := []struct {
+		name  string
+		keys  *Keyring
+		token string
+		err   error
+	}{
+		{name: "old token while rotating", keys: during, token: oldToken},
+		{name: "new token while rotating", keys: during, token: newToken},
+		{name: "new token after rotation", keys: after, token: newToken},
+		{name: "old token after rotation", keys: after, token: oldToken, err: ErrInvalidToken},
+		{name: "new token before rotation", keys: before, token: newToken, err: ErrInvalidToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.keys.Verify(tt.token, PurposeSession); !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestIssue(t *testing.T) {
+	keys := mustKeyring(t, "main:"+newSecret)
+	token, expiresAt, err := keys.Issue("alice", PurposeInvite, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if until := time.Until(expiresAt); until < 59*time.Minute || until > time.Hour {
+		t.Errorf("expiresAt is %v away, want about an hour", until)
+	}
+
+	claims, err := keys.Verify(token, PurposeInvite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "alice" || claims.ExpiresAt != expiresAt.Unix() || claims.IssuedAt > claims.ExpiresAt {
+		t.Errorf("claims = %+v", claims)
+	}
+}
+
+func TestRandomKeyrings(t *testing.T) {
+	a, err := NewRandomKeyring()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewRandomKeyring()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, _, err := a.Issue("alice", PurposeSession, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Verify(token, PurposeSession); err != nil {
+		t.Errorf("own token: %v", err)
+	}
+	if _, err := b.Verify(token, PurposeSession); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("other keyring's token: err = %v, want %v", err, ErrInvalidToken)
+	}
+}
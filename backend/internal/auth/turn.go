@@ -0,0 +1,26 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"time"
+)
+
+// TURNCredentials mints a time-limited TURN username and password using
+// the TURN REST API scheme, as understood by coturn's use-auth-secret: the
+// username is expiry:userID and the password is the base64 HMAC-SHA1 of
+// the username keyed with the shared secret.
+func TURNCredentials(secret, userID string, ttl time.Duration) (username, password string, expiresAt time.Time) {
+	expiresAt = time.Now().Add(ttl)
+	username = fmt.Sprintf("%d:%s", expiresAt.Unix(), userID)
+	return username, TURNPassword(secret, username), expiresAt
+}
+
+// TURNPassword derives the password for a TURN REST API username.
+func TURNPassword(secret, username string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
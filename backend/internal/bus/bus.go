@@ -0,0 +1,93 @@
+// Package bus carries events between server instances, so members whose
+// connections land on different instances can still see and signal each
+// other.
+package bus
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrClosed is returned when publishing on a bus that has been closed.
+var ErrClosed = errors.New("bus closed")
+
+// Bus delivers every published payload to every subscriber on every
+// instance, the publisher's own included. Payloads from one instance
+// arrive in the order it published them; delivery is at most once.
+type Bus interface {
+	// Publish queues payload and returns without waiting for it to be
+	// sent, so it is safe to call while holding locks.
+	Publish(payload []byte) error
+	// Subscribe registers handler for payloads published from now on.
+	// Handlers run one at a time, so a slow handler holds up the rest.
+	Subscribe(handler func(payload []byte))
+	Close() error
+}
+
+// Local is a Bus for a single instance, or for several in one process.
+type Local struct {
+	mu       sync.Mutex
+	handlers []func([]byte)
+	queue    [][]byte
+	closed   bool
+
+	wake chan struct{}
+	done chan struct{}
+}
+
+func NewLocal() *Local {
+	b := &Local{
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+func (b *Local) Publish(payload []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return ErrClosed
+	}
+	b.queue = append(b.queue, payload)
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (b *Local) Subscribe(handler func(payload []byte)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers = append(b.handlers, handler)
+}
+
+// Close stops delivery once what is already queued has been handled.
+func (b *Local) Close() error {
+	b.mu.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.wake)
+	}
+	b.mu.Unlock()
+	<-b.done
+	return nil
+}
+
+func (b *Local) run() {
+	defer close(b.done)
+	for range b.wake {
+		b.mu.Lock()
+		batch, handlers := b.queue, b.handlers
+		b.queue = nil
+		b.mu.Unlock()
+
+		for _, payload := range batch {
+			for _, handler := range handlers {
+				handler(payload)
+			}
+		}
+	}
+}
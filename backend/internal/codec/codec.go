@@ -0,0 +1,105 @@
+// Package codec encodes WebSocket messages in the formats a client can pick
+// through the Sec-WebSocket-Protocol header.
+package codec
+
+import (
+	"encoding/json"
+	"reflect"
+
+	"github.com/gorilla/websocket"
+	ugorji "github.com/ugorji/go/codec"
+)
+
+// Codec converts messages to and from WebSocket frames.
+type Codec interface {
+	// Subprotocol is the Sec-WebSocket-Protocol value that selects the codec.
+	Subprotocol() string
+	// FrameType is the WebSocket message type frames are written as.
+	FrameType() int
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	JSON        Codec = jsonCodec{}
+	MessagePack Codec = binaryCodec{subprotocol: "portal.msgpack", handle: newMsgpackHandle()}
+	CBOR        Codec = binaryCodec{subprotocol: "portal.cbor", handle: newCBORHandle()}
+)
+
+// supported is in order of server preference; binary codecs win when a
+// client offers several.
+var supported = []Codec{MessagePack, CBOR, JSON}
+
+// Subprotocols lists every subprotocol the server accepts.
+func Subprotocols() []string {
+	names := make([]string, len(supported))
+	for i, c := range supported {
+		names[i] = c.Subprotocol()
+	}
+	return names
+}
+
+// ForSubprotocol returns the codec for a negotiated subprotocol. Clients
+// that did not negotiate one get JSON.
+func ForSubprotocol(name string) Codec {
+	for _, c := range supported {
+		if c.Subprotocol() == name {
+			return c
+		}
+	}
+	return JSON
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Subprotocol() string { return "portal.json" }
+func (jsonCodec) FrameType() int      { return websocket.TextMessage }
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type binaryCodec struct {
+	subprotocol string
+	handle      ugorji.Handle
+}
+
+func (c binaryCodec) Subprotocol() string { return c.subprotocol }
+func (c binaryCodec) FrameType() int      { return websocket.BinaryMessage }
+
+func (c binaryCodec) Marshal(v interface{}) ([]byte, error) {
+	var data []byte
+	err := ugorji.NewEncoderBytes(&data, c.handle).Encode(v)
+	return data, err
+}
+
+func (c binaryCodec) Unmarshal(data []byte, v interface{}) error {
+	return ugorji.NewDecoderBytes(data, c.handle).Decode(v)
+}
+
+// Binary payloads decode into the same shapes as JSON ones, with string
+// keyed maps, and struct fields use their json tags.
+var (
+	mapType   = reflect.TypeOf(map[string]interface{}(nil))
+	typeInfos = ugorji.NewTypeInfos([]string{"json"})
+)
+
+func newMsgpackHandle() *ugorji.MsgpackHandle {
+	h := &ugorji.MsgpackHandle{}
+	h.MapType = mapType
+	h.TypeInfos = typeInfos
+	h.RawToString = true
+	h.WriteExt = true
+	return h
+}
+
+func newCBORHandle() *ugorji.CborHandle {
+	h := &ugorji.CborHandle{}
+	h.MapType = mapType
+	h.TypeInfos = typeInfos
+	return h
+}
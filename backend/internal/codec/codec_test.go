@@ -0,0 +1,143 @@
+package codec
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// envelope mirrors models.Message, which cannot be imported here without a
+// cycle: a typed header and a payload left to decode generically.
+type envelope struct {
+	Type    string      `json:"type"`
+	RoomID  string      `json:"roomId,omitempty"`
+	Payload interface{} `json:"payload,omitempty"`
+}
+
+type joinPayload struct {
+	Username string            `json:"username"`
+	AvatarID string            `json:"avatarId"`
+	Password string            `json:"password,omitempty"`
+	Volume   int               `json:"volume"`
+	Muted    bool              `json:"muted"`
+	Tags     []string          `json:"tags"`
+	Extra    map[string]string `json:"extra"`
+}
+
+func TestForSubprotocol(t *testing.T) {
+	tests := []struct {
+		name string
+		want Codec
+	}{
+		{name: "portal.msgpack", want: MessagePack},
+		{name: "portal.cbor", want: CBOR},
+		{name: "portal.json", want: JSON},
+		{name: "", want: JSON},
+		{name: "portal.token.abc", want: JSON},
+		{name: "msgpack", want: JSON},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ForSubprotocol(tt.name); got.Subprotocol() != tt.want.Subprotocol() {
+				t.Errorf("ForSubprotocol(%q) = %s, want %s", tt.name, got.Subprotocol(), tt.want.Subprotocol())
+			}
+		})
+	}
+}
+
+func TestSubprotocols(t *testing.T) {
+	want := []string{"portal.msgpack", "portal.cbor", "portal.json"}
+	if got := Subprotocols(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Subprotocols() = %v, want %v", got, want)
+	}
+}
+
+// Every codec must hand the server the same generic payload JSON would,
+// since payloads are decoded into their structs by way of JSON.
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name      string
+		codec     Codec
+		frameType int
+	}{
+		{name: "json", codec: JSON, frameType: websocket.TextMessage},
+		{name: "msgpack", codec: MessagePack, frameType: websocket.BinaryMessage},
+		{name: "cbor", codec: CBOR, frameType: websocket.BinaryMessage},
+	}
+
+	messages := []envelope{
+		{Type: "leave_room", RoomID: "room0001"},
+		{Type: "join_room", RoomID: "room0001", Payload: joinPayload{
+			Username: "alice", AvatarID: "kazuha", Volume: -3, Muted: true,
+			Tags: []string{"a", "b"}, Extra: map[string]string{"lang": "ja"},
+		}},
+		{Type: "signal", Payload: map[string]interface{}{
+			"candidates": []interface{}{map[string]interface{}{"sdpMLineIndex": 0, "candidate": "candidate:1"}},
+			"large":      uint64(1) << 40,
+			"ratio":      0.5,
+			"none":       nil,
+		}},
+		{Type: "resume", Payload: map[string]interface{}{"unicode": "ポータル", "empty": ""}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.codec.FrameType() != tt.frameType {
+				t.Errorf("FrameType() = %d, want %d", tt.codec.FrameType(), tt.frameType)
+			}
+
+			for _, msg := range messages {
+				data, err := tt.codec.Marshal(msg)
+				if err != nil {
+					t.Fatalf("Marshal(%s): %v", msg.Type, err)
+				}
+				var decoded envelope
+				if err := tt.codec.Unmarshal(data, &decoded); err != nil {
+					t.Fatalf("Unmarshal(%s): %v", msg.Type, err)
+				}
+
+				if decoded.Type != msg.Type || decoded.RoomID != msg.RoomID {
+					t.Errorf("%s: header = %+v", msg.Type, decoded)
+				}
+				if decoded.Payload != nil {
+					if _, ok := decoded.Payload.(map[string]interface{}); !ok {
+						t.Errorf("%s: payload decoded as %T, want map[string]interface{}", msg.Type, decoded.Payload)
+					}
+				}
+
+				got, err := json.Marshal(decoded.Payload)
+				if err != nil {
+					t.Fatalf("%s: payload does not convert to JSON: %v", msg.Type, err)
+				}
+				want, _ := json.Marshal(msg.Payload)
+				if !jsonEqual(t, got, want) {
+					t.Errorf("%s: payload = %s, want %s", msg.Type, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestUnmarshalGarbage(t *testing.T) {
+	for _, c := range []Codec{JSON, MessagePack, CBOR} {
+		var msg envelope
+		if err := c.Unmarshal([]byte{0xc1, 0xff, 0x00}, &msg); err == nil {
+			t.Errorf("%s decoded garbage into %+v", c.Subprotocol(), msg)
+		}
+	}
+}
+
+func jsonEqual(t *testing.T, a, b []byte) bool {
+	t.Helper()
+	var x, y interface{}
+	if err := json.Unmarshal(a, &x); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, &y); err != nil {
+		t.Fatal(err)
+	}
+	return reflect.DeepEqual(x, y)
+}
@@ -1,23 +1,446 @@
 package config
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
+	"portal/internal/models"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
+	"golang.org/x/crypto/bcrypt"
 )
 
 type Config struct {
 	ServerAddress string
 	DatabaseURL   string
+
+	// MetricsAddress is where Prometheus metrics are served at /metrics,
+	// apart from the public API. Empty turns them off.
+	MetricsAddress string
+
+	// SessionKeys is a comma-separated list of id:secret pairs used to sign
+	// session tokens. The first key signs; the rest are accepted while
+	// rotating. Empty means a random key per process, which only a single
+	// instance can use.
+	SessionKeys string
+	SessionTTL  time.Duration
+
+	// PasswordCost is the bcrypt cost for room passwords. Existing hashes
+	// are upgraded on the next successful join after it changes.
+	PasswordCost int
+
+	// Failed private room joins lock out the client IP, and separately the
+	// room for everyone but its creator, once they reach these thresholds.
+	// The lockout starts at JoinLockoutBaseDelay and doubles per further
+	// failure. Invites bypass both.
+	JoinLockoutIPThreshold   int
+	JoinLockoutRoomThreshold int
+	JoinLockoutBaseDelay     time.Duration
+	JoinLockoutMaxDelay      time.Duration
+
+	// The server pings WebSocket clients every HeartbeatInterval and drops
+	// any that send nothing, pongs included, for HeartbeatTimeout. Members
+	// quiet for PresenceIdleAfter are shown as idle; zero disables that.
+	HeartbeatInterval time.Duration
+	HeartbeatTimeout  time.Duration
+	PresenceIdleAfter time.Duration
+
+	// Each WebSocket client has a queue of SendQueueSize outgoing messages.
+	// SlowClientPolicy decides what happens when it fills up: drop the new
+	// message, coalesce queued ICE candidates and drop only if that frees
+	// nothing, or disconnect the client.
+	SendQueueSize    int
+	SlowClientPolicy string
+
+	// On SIGINT or SIGTERM the server tells WebSocket clients to reconnect
+	// after ShutdownReconnectAfter, plus up to as much again of jitter, and
+	// waits up to ShutdownDrainPeriod for them to disconnect before exiting.
+	ShutdownDrainPeriod    time.Duration
+	ShutdownReconnectAfter time.Duration
+
+	// ClusterBus carries room events between instances: local for a single
+	// instance, or postgres to run several behind a load balancer. NodeID
+	// names this instance on the bus and must be unique among them. Every
+	// instance announces itself each ClusterHeartbeatInterval; one silent
+	// for three intervals is presumed dead and its members are dropped.
+	ClusterBus               string
+	NodeID                   string
+	ClusterHeartbeatInterval time.Duration
+
+	// SessionPolicy decides what happens when a user who is already
+	// connected, on any instance, connects again: allow multiple sessions,
+	// let the new one take over and close the old, or reject the new one.
+	SessionPolicy string
+
+	// ResumeGracePeriod is how long a dropped WebSocket client keeps its
+	// room memberships, waiting to be resumed. Zero removes it at once.
+	ResumeGracePeriod time.Duration
+
+	// TrustedProxies lists the proxies allowed to set X-Forwarded-For.
+	// Client IPs feed the join lockout, so only list proxies you run.
+	TrustedProxies []string
+
+	// ICEServers is handed to clients for their RTCPeerConnection config.
+	ICEServers []models.ICEServer
+
+	// TURNSecret is the shared secret for minting TURN credentials, the
+	// same value as coturn's static-auth-secret. Changing it invalidates
+	// every credential already handed out.
+	TURNSecret        string
+	TURNURLs          []string
+	TURNCredentialTTL time.Duration
+
+	// The embedded TURN/STUN server is off unless TURNEnabled is set.
+	// TURNRelayIP is the address advertised to peers for relayed traffic,
+	// so it must be reachable by them; loopback only works locally.
+	TURNEnabled          bool
+	TURNRealm            string
+	TURNListenAddress    string
+	TURNUDPPort          int // 0 disables the UDP listener
+	TURNTCPPort          int // 0 disables the TCP listener
+	TURNRelayIP          string
+	TURNRelayBindAddress string
+	TURNRelayMinPort     uint16
+	TURNRelayMaxPort     uint16
+	TURNUserBandwidth    int // Bytes per second per user, 0 for unlimited
+}
+
+// Slow client policies.
+const (
+	SlowClientDrop       = "drop"
+	SlowClientCoalesce   = "coalesce"
+	SlowClientDisconnect = "disconnect"
+)
+
+// Session policies.
+const (
+	SessionMultiple = "multiple"
+	SessionTakeover = "takeover"
+	SessionReject   = "reject"
+)
+
+// Cluster buses.
+const (
+	ClusterBusLocal    = "local"
+	ClusterBusPostgres = "postgres"
+)
+
+var defaultICEServers = []models.ICEServer{
+	{URLs: []string{"stun:stun.l.google.com:19302"}},
 }
 
+// Load reads configuration from the environment and .env. When PORTAL_ENV
+// is set, .env.<PORTAL_ENV> is loaded first so its values override .env;
+// variables already in the process environment override both.
 func Load() (*Config, error) {
+	base, err := godotenv.Read()
+	if err != nil {
+		return nil, err
+	}
+	if env := getEnv("PORTAL_ENV", base["PORTAL_ENV"]); env != "" {
+		if err := godotenv.Load(".env." + env); err != nil {
+			return nil, err
+		}
+	}
 	if err := godotenv.Load(); err != nil {
 		return nil, err
 	}
 
+	sessionTTL, err := getDuration("SESSION_TTL", 30*24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+
+	passwordCost, err := getInt("ROOM_PASSWORD_COST", bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	if passwordCost < bcrypt.MinCost || passwordCost > bcrypt.MaxCost {
+		return nil, fmt.Errorf("invalid ROOM_PASSWORD_COST: must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+
+	ipThreshold, err := getInt("JOIN_LOCKOUT_IP_THRESHOLD", 5)
+	if err != nil {
+		return nil, err
+	}
+	roomThreshold, err := getInt("JOIN_LOCKOUT_ROOM_THRESHOLD", 20)
+	if err != nil {
+		return nil, err
+	}
+	lockoutBase, err := getDuration("JOIN_LOCKOUT_BASE_DELAY", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	lockoutMax, err := getDuration("JOIN_LOCKOUT_MAX_DELAY", 15*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+
+	resumeGrace, err := getDuration("RESUME_GRACE_PERIOD", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	heartbeatInterval, err := getDuration("HEARTBEAT_INTERVAL", 25*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	heartbeatTimeout, err := getDuration("HEARTBEAT_TIMEOUT", 60*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if heartbeatInterval <= 0 || heartbeatTimeout <= heartbeatInterval {
+		return nil, errors.New("HEARTBEAT_TIMEOUT must be longer than a positive HEARTBEAT_INTERVAL")
+	}
+	idleAfter, err := getDuration("PRESENCE_IDLE_AFTER", 5*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+
+	drainPeriod, err := getDuration("SHUTDOWN_DRAIN_PERIOD", 15*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	reconnectAfter, err := getDuration("SHUTDOWN_RECONNECT_AFTER", 2*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	sessionPolicy := getEnv("SESSION_POLICY", SessionTakeover)
+	switch sessionPolicy {
+	case SessionMultiple, SessionTakeover, SessionReject:
+	default:
+		return nil, fmt.Errorf("invalid SESSION_POLICY %q: must be multiple, takeover or reject", sessionPolicy)
+	}
+
+	clusterBus := getEnv("CLUSTER_BUS", ClusterBusLocal)
+	switch clusterBus {
+	case ClusterBusLocal, ClusterBusPostgres:
+	default:
+		return nil, fmt.Errorf("invalid CLUSTER_BUS %q: must be local or postgres", clusterBus)
+	}
+	sessionKeys := os.Getenv("SESSION_KEYS")
+	if sessionKeys == "" && clusterBus == ClusterBusPostgres {
+		// A random key per process would make every instance reject the
+		// tokens the others sign
+		return nil, errors.New("SESSION_KEYS must be set when CLUSTER_BUS is postgres")
+	}
+	nodeID := os.Getenv("NODE_ID")
+	if nodeID == "" {
+		nodeID = defaultNodeID()
+	}
+	clusterHeartbeat, err := getDuration("CLUSTER_HEARTBEAT_INTERVAL", 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if clusterHeartbeat <= 0 {
+		return nil, errors.New("invalid CLUSTER_HEARTBEAT_INTERVAL: must be positive")
+	}
+
+	sendQueueSize, err := getInt("SEND_QUEUE_SIZE", 256)
+	if err != nil {
+		return nil, err
+	}
+	// A resumed session's replay needs room for session_resumed, the ack
+	// and at least one missed message
+	if sendQueueSize < 3 {
+		return nil, errors.New("invalid SEND_QUEUE_SIZE: must be at least 3")
+	}
+	slowClientPolicy := getEnv("SLOW_CLIENT_POLICY", SlowClientCoalesce)
+	switch slowClientPolicy {
+	case SlowClientDrop, SlowClientCoalesce, SlowClientDisconnect:
+	default:
+		return nil, fmt.Errorf("invalid SLOW_CLIENT_POLICY %q: must be drop, coalesce or disconnect", slowClientPolicy)
+	}
+
+	iceServers, err := getICEServers("ICE_SERVERS")
+	if err != nil {
+		return nil, err
+	}
+	turnTTL, err := getDuration("TURN_CREDENTIAL_TTL", 12*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	turnUDPPort, err := getInt("TURN_UDP_PORT", 3478)
+	if err != nil {
+		return nil, err
+	}
+	turnTCPPort, err := getInt("TURN_TCP_PORT", 3478)
+	if err != nil {
+		return nil, err
+	}
+	relayMinPort, err := getInt("TURN_RELAY_MIN_PORT", 49152)
+	if err != nil {
+		return nil, err
+	}
+	relayMaxPort, err := getInt("TURN_RELAY_MAX_PORT", 65535)
+	if err != nil {
+		return nil, err
+	}
+	if relayMinPort < 1 || relayMaxPort > 65535 || relayMinPort > relayMaxPort {
+		return nil, fmt.Errorf("invalid TURN relay port range %d-%d", relayMinPort, relayMaxPort)
+	}
+	turnBandwidth, err := getInt("TURN_USER_BANDWIDTH", 0)
+	if err != nil {
+		return nil, err
+	}
+	if turnBandwidth < 0 {
+		return nil, errors.New("invalid TURN_USER_BANDWIDTH: must not be negative")
+	}
+
+	turnEnabled := os.Getenv("TURN_ENABLED") == "true"
+	turnRelayIP := getEnv("TURN_RELAY_IP", "127.0.0.1")
+	turnURLs := getList("TURN_URLS")
+	if turnEnabled && len(turnURLs) == 0 {
+		// Point clients at the embedded server unless told otherwise
+		if turnUDPPort != 0 {
+			turnURLs = append(turnURLs, fmt.Sprintf("turn:%s:%d?transport=udp", turnRelayIP, turnUDPPort))
+		}
+		if turnTCPPort != 0 {
+			turnURLs = append(turnURLs, fmt.Sprintf("turn:%s:%d?transport=tcp", turnRelayIP, turnTCPPort))
+		}
+	}
+
+	// Set but empty turns metrics off, unlike an unset variable
+	metricsAddress, set := os.LookupEnv("METRICS_ADDRESS")
+	if !set {
+		metricsAddress = "127.0.0.1:9090"
+	}
+
 	return &Config{
-		ServerAddress: os.Getenv("SERVER_ADDRESS"),
-		DatabaseURL:   os.Getenv("DATABASE_URL"),
+		ServerAddress:  getEnv("SERVER_ADDRESS", ":8080"),
+		DatabaseURL:    os.Getenv("DATABASE_URL"),
+		MetricsAddress: metricsAddress,
+		SessionKeys:    sessionKeys,
+		SessionTTL:     sessionTTL,
+		PasswordCost:   passwordCost,
+
+		JoinLockoutIPThreshold:   ipThreshold,
+		JoinLockoutRoomThreshold: roomThreshold,
+		JoinLockoutBaseDelay:     lockoutBase,
+		JoinLockoutMaxDelay:      lockoutMax,
+
+		HeartbeatInterval: heartbeatInterval,
+		HeartbeatTimeout:  heartbeatTimeout,
+		PresenceIdleAfter: idleAfter,
+		ResumeGracePeriod: resumeGrace,
+		SessionPolicy:     sessionPolicy,
+
+		ShutdownDrainPeriod:    drainPeriod,
+		ShutdownReconnectAfter: reconnectAfter,
+
+		SendQueueSize:    sendQueueSize,
+		SlowClientPolicy: slowClientPolicy,
+
+		ClusterBus:               clusterBus,
+		NodeID:                   nodeID,
+		ClusterHeartbeatInterval: clusterHeartbeat,
+
+		TrustedProxies: getList("TRUSTED_PROXIES"),
+
+		ICEServers: iceServers,
+
+		TURNSecret:        os.Getenv("TURN_SECRET"),
+		TURNURLs:          turnURLs,
+		TURNCredentialTTL: turnTTL,
+
+		TURNEnabled:          turnEnabled,
+		TURNRealm:            getEnv("TURN_REALM", "portal"),
+		TURNListenAddress:    getEnv("TURN_LISTEN_ADDRESS", "0.0.0.0"),
+		TURNUDPPort:          turnUDPPort,
+		TURNTCPPort:          turnTCPPort,
+		TURNRelayIP:          turnRelayIP,
+		TURNRelayBindAddress: getEnv("TURN_RELAY_BIND_ADDRESS", "0.0.0.0"),
+		TURNRelayMinPort:     uint16(relayMinPort),
+		TURNRelayMaxPort:     uint16(relayMaxPort),
+		TURNUserBandwidth:    turnBandwidth,
 	}, nil
 }
+
+// defaultNodeID is the hostname plus a random suffix, so a restarted
+// instance is never mistaken for the one it replaced.
+func defaultNodeID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "portal"
+	}
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return host + "-" + hex.EncodeToString(suffix)
+}
+
+func getEnv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func getList(key string) []string {
+	var values []string
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// getICEServers accepts either a JSON array of RTCIceServer objects, for
+// servers that need credentials, or a comma-separated list of URLs.
+func getICEServers(key string) ([]models.ICEServer, error) {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return defaultICEServers, nil
+	}
+
+	if strings.HasPrefix(value, "[") {
+		var servers []models.ICEServer
+		if err := json.Unmarshal([]byte(value), &servers); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", key, err)
+		}
+		for _, server := range servers {
+			if len(server.URLs) == 0 {
+				return nil, fmt.Errorf("invalid %s: every server needs at least one URL", key)
+			}
+		}
+		return servers, nil
+	}
+
+	servers := make([]models.ICEServer, 0)
+	for _, url := range getList(key) {
+		servers = append(servers, models.ICEServer{URLs: []string{url}})
+	}
+	return servers, nil
+}
+
+func getInt(key string, fallback int) (int, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return n, nil
+}
+
+func getDuration(key string, fallback time.Duration) (time.Duration, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return d, nil
+}
@@ -0,0 +1,299 @@
+package db
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"portal/internal/bus"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	busChannel = "portal_bus"
+	// maxNotifyPayload keeps clear of Postgres's 8000 byte NOTIFY limit.
+	// Larger payloads are stored in bus_messages and the NOTIFY carries
+	// their id.
+	maxNotifyPayload = 7900
+	// busMessageTTL is how long stored payloads are kept for listeners to
+	// fetch.
+	busMessageTTL = time.Minute
+	// maxBusQueue bounds the payloads waiting to be sent while the
+	// database is slow or unreachable. The oldest are dropped first.
+	maxBusQueue = 4096
+)
+
+// storedPayloadPrefix marks a NOTIFY that carries a bus_messages id, and
+// bundlePrefix one that carries a JSON array of payloads. Bus payloads are
+// JSON objects, so they never start with either.
+const (
+	storedPayloadPrefix = "@"
+	bundlePrefix        = "["
+)
+
+// PostgresBus is a bus.Bus over LISTEN/NOTIFY, shared by every instance
+// using the same database.
+type PostgresBus struct {
+	db       *sql.DB
+	listener *pq.Listener
+
+	mu       sync.Mutex
+	handlers []func([]byte)
+	queue    [][]byte
+	dropped  int
+	closed   bool
+
+	wake chan struct{}
+	sent chan struct{} // Closed once the queue is sent after Close
+	done chan struct{}
+}
+
+// NewPostgresBus listens for bus payloads on a connection of its own to
+// url, which should be the database's URL.
+func NewPostgresBus(database *Database, url string) (*PostgresBus, error) {
+	listener := pq.NewListener(url, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("error on bus listener: %v", err)
+		}
+	})
+	if err := listener.Listen(busChannel); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	b := &PostgresBus{
+		db:       database.db,
+		listener: listener,
+		wake:     make(chan struct{}, 1),
+		sent:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go b.send()
+	go b.run()
+	go b.prune()
+	return b, nil
+}
+
+func (b *PostgresBus) Publish(payload []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return bus.ErrClosed
+	}
+	if len(b.queue) == maxBusQueue {
+		b.queue = b.queue[1:]
+		b.dropped++
+	}
+	b.queue = append(b.queue, payload)
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// send publishes queued payloads in order until the bus is closed.
+func (b *PostgresBus) send() {
+	defer close(b.sent)
+	for range b.wake {
+		b.mu.Lock()
+		batch, dropped := b.queue, b.dropped
+		b.queue, b.dropped = nil, 0
+		b.mu.Unlock()
+
+		if dropped > 0 {
+			log.Printf("bus queue full, dropped %d payloads", dropped)
+		}
+		for _, n := range pack(batch) {
+			if err := b.notify(n); err != nil {
+				log.Printf("error publishing bus payload: %v", err)
+			}
+		}
+	}
+}
+
+// notification is the text of one NOTIFY, or a payload too large for one
+// that has to be stored first.
+type notification struct {
+	text   string
+	stored []byte
+}
+
+// pack bundles payloads, in order, into as few notifications as fit under
+// maxNotifyPayload, so a burst of events costs one round trip per
+// notification rather than per payload.
+func pack(payloads [][]byte) []notification {
+	var packed []notification
+	var bundle [][]byte
+	size := 0 // Bytes in bundle as a JSON array
+
+	flush := func() {
+		switch len(bundle) {
+		case 0:
+			return
+		case 1:
+			packed = append(packed, notification{text: string(bundle[0])})
+		default:
+			packed = append(packed, notification{text: bundlePrefix + string(bytes.Join(bundle, []byte(","))) + "]"})
+		}
+		bundle, size = nil, 0
+	}
+
+	for _, payload := range payloads {
+		if len(payload) > maxNotifyPayload {
+			flush()
+			packed = append(packed, notification{stored: payload})
+			continue
+		}
+		// A lone payload is sent as it is; brackets and commas only
+		// appear once there are two
+		grown := len(payload) + 1
+		if len(bundle) == 0 {
+			grown = len(payload) + 2
+		}
+		if len(bundle) > 0 && size+grown > maxNotifyPayload {
+			flush()
+			grown = len(payload) + 2
+		}
+		bundle = append(bundle, payload)
+		size += grown
+	}
+	flush()
+	return packed
+}
+
+// unpack returns the payloads a NOTIFY carries, or the id of the one it
+// stored.
+func unpack(text string) (payloads [][]byte, storedID string, err error) {
+	if id, stored := strings.CutPrefix(text, storedPayloadPrefix); stored {
+		return nil, id, nil
+	}
+	if !strings.HasPrefix(text, bundlePrefix) {
+		return [][]byte{[]byte(text)}, "", nil
+	}
+
+	var bundle []json.RawMessage
+	if err := json.Unmarshal([]byte(text), &bundle); err != nil {
+		return nil, "", err
+	}
+	payloads = make([][]byte, len(bundle))
+	for i, payload := range bundle {
+		payloads[i] = payload
+	}
+	return payloads, "", nil
+}
+
+// notify sends n with NOTIFY, storing its payload first if it has one.
+func (b *PostgresBus) notify(n notification) error {
+	text := n.text
+	if n.stored != nil {
+		var id int64
+		err := b.db.QueryRow(`
+			INSERT INTO bus_messages (payload) VALUES ($1) RETURNING id
+		`, n.stored).Scan(&id)
+		if err != nil {
+			return err
+		}
+		text = storedPayloadPrefix + strconv.FormatInt(id, 10)
+	}
+
+	_, err := b.db.Exec(`SELECT pg_notify($1, $2)`, busChannel, text)
+	return err
+}
+
+func (b *PostgresBus) Subscribe(handler func(payload []byte)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers = append(b.handlers, handler)
+}
+
+// Close sends what is already queued and stops listening.
+func (b *PostgresBus) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	close(b.wake)
+	b.mu.Unlock()
+
+	<-b.sent
+	close(b.done)
+	return b.listener.Close()
+}
+
+func (b *PostgresBus) run() {
+	ping := time.NewTicker(90 * time.Second)
+	defer ping.Stop()
+
+	for {
+		select {
+		case n, ok := <-b.listener.Notify:
+			if !ok {
+				return
+			}
+			// The listener reconnected and may have missed payloads
+			if n == nil {
+				log.Printf("bus listener reconnected, payloads may have been lost")
+				continue
+			}
+			payloads, err := b.load(n.Extra)
+			if err != nil {
+				log.Printf("error loading bus payload %s: %v", n.Extra, err)
+				continue
+			}
+			b.mu.Lock()
+			handlers := b.handlers
+			b.mu.Unlock()
+			for _, payload := range payloads {
+				for _, handler := range handlers {
+					handler(payload)
+				}
+			}
+		case <-ping.C:
+			// Notices a dead connection when nothing is being published
+			go b.listener.Ping()
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// load returns the payloads a NOTIFY carries, fetching the one it stored
+// if it did.
+func (b *PostgresBus) load(text string) ([][]byte, error) {
+	payloads, id, err := unpack(text)
+	if err != nil || id == "" {
+		return payloads, err
+	}
+
+	var payload []byte
+	err = b.db.QueryRow(`SELECT payload FROM bus_messages WHERE id = $1`, id).Scan(&payload)
+	return [][]byte{payload}, err
+}
+
+// prune deletes stored payloads every listener has had time to fetch.
+func (b *PostgresBus) prune() {
+	ticker := time.NewTicker(busMessageTTL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			_, err := b.db.Exec(`
+				DELETE FROM bus_messages WHERE created_at < now() - make_interval(secs => $1)
+			`, busMessageTTL.Seconds())
+			if err != nil {
+				log.Printf("error pruning bus messages: %v", err)
+			}
+		case <-b.done:
+			return
+		}
+	}
+}
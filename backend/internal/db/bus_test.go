@@ -0,0 +1,114 @@
+package db
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// payload returns a JSON object n bytes long, tagged so it can be told
+// apart from the others.
+func payload(tag string, n int) []byte {
+	prefix := `{"` + tag + `":"`
+	return []byte(prefix + strings.Repeat("x", n-len(prefix)-2) + `"}`)
+}
+
+func TestPack(t *testing.T) {
+	a, b, c := payload("a", 100), payload("b", 100), payload("c", 100)
+	// Two payloads bundle into brackets, a comma and themselves
+	first := (maxNotifyPayload - 3) / 2
+	second := maxNotifyPayload - 3 - first
+
+	tests := []struct {
+		name     string
+		payloads [][]byte
+		// want describes each notification: the payload tags it bundles,
+		// or "stored:" and the tag of the one it stores
+		want []string
+	}{
+		{name: "nothing", want: nil},
+		{name: "lone payload", payloads: [][]byte{a}, want: []string{"a"}},
+		{name: "bundled", payloads: [][]byte{a, b, c}, want: []string{"a,b,c"}},
+		{name: "oversize stored in order", payloads: [][]byte{a, b, payload("big", maxNotifyPayload+1), c},
+			want: []string{"a,b", "stored:big", "c"}},
+		{name: "largest lone payload", payloads: [][]byte{payload("max", maxNotifyPayload), a},
+			want: []string{"max", "a"}},
+		{name: "bundle filled to the limit", payloads: [][]byte{payload("h1", first), payload("h2", second), a},
+			want: []string{"h1,h2", "a"}},
+		{name: "one byte over the limit", payloads: [][]byte{payload("h1", first), payload("h2", second+1)},
+			want: []string{"h1", "h2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			packed := pack(tt.payloads)
+
+			var got []string
+			var unpacked [][]byte
+			for _, n := range packed {
+				if n.stored != nil {
+					got = append(got, "stored:"+tag(n.stored))
+					unpacked = append(unpacked, n.stored)
+					continue
+				}
+				if len(n.text) > maxNotifyPayload {
+					t.Errorf("notification of %d bytes, over the %d byte limit", len(n.text), maxNotifyPayload)
+				}
+				payloads, id, err := unpack(n.text)
+				if err != nil || id != "" {
+					t.Fatalf("unpack(%.40q) = %v, %q", n.text, err, id)
+				}
+				var tags []string
+				for _, p := range payloads {
+					tags = append(tags, tag(p))
+				}
+				got = append(got, strings.Join(tags, ","))
+				unpacked = append(unpacked, payloads...)
+			}
+
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("pack() = %v, want %v", got, tt.want)
+			}
+			if len(unpacked) != len(tt.payloads) {
+				t.Fatalf("%d payloads came back, want %d", len(unpacked), len(tt.payloads))
+			}
+			for i := range unpacked {
+				if !bytes.Equal(unpacked[i], tt.payloads[i]) {
+					t.Errorf("payload %d changed in transit", i)
+				}
+			}
+		})
+	}
+}
+
+func TestUnpack(t *testing.T) {
+	tests := []struct {
+		text     string
+		payloads int
+		storedID string
+		err      bool
+	}{
+		{text: `{"kind":"joined"}`, payloads: 1},
+		{text: `[{"kind":"joined"},{"kind":"left"}]`, payloads: 2},
+		{text: `@42`, storedID: "42"},
+		{text: `[{"kind":"joined"},`, err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			payloads, id, err := unpack(tt.text)
+			if (err != nil) != tt.err {
+				t.Fatalf("err = %v", err)
+			}
+			if len(payloads) != tt.payloads || id != tt.storedID {
+				t.Errorf("unpack() = %d payloads, id %q, want %d, %q", len(payloads), id, tt.payloads, tt.storedID)
+			}
+		})
+	}
+}
+
+// tag returns the key a payload made by payload was tagged with.
+func tag(p []byte) string {
+	key, _, _ := strings.Cut(strings.TrimPrefix(string(p), `{"`), `"`)
+	return key
+}
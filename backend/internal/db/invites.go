@@ -0,0 +1,125 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"portal/internal/models"
+)
+
+var (
+	ErrInviteNotFound = errors.New("invite not found")
+	ErrInviteUnusable = errors.New("invite is revoked, expired, used up or meant for someone else")
+)
+
+// InviteStore persists invites to private rooms.
+type InviteStore interface {
+	CreateInvite(invite *models.Invite) error
+	ListInvites(roomID string) ([]*models.Invite, error)
+	RevokeInvite(roomID, id string) error
+	RedeemInvite(roomID, id, userID string) error
+	ReleaseInvite(roomID, id string) error
+}
+
+type PostgresInviteStore struct {
+	db *sql.DB
+}
+
+func NewPostgresInviteStore(database *Database) *PostgresInviteStore {
+	return &PostgresInviteStore{db: database.db}
+}
+
+func (s *PostgresInviteStore) CreateInvite(invite *models.Invite) error {
+	return s.db.QueryRow(`
+		INSERT INTO room_invites (room_id, created_by, recipient_id, max_uses, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at
+	`, invite.RoomID, invite.CreatedBy, invite.RecipientID, invite.MaxUses, invite.ExpiresAt).Scan(&invite.ID, &invite.CreatedAt)
+}
+
+func (s *PostgresInviteStore) ListInvites(roomID string) ([]*models.Invite, error) {
+	rows, err := s.db.Query(`
+		SELECT id, room_id, created_by, recipient_id, max_uses, uses, expires_at, revoked_at, created_at
+		FROM room_invites
+		WHERE room_id = $1
+		ORDER BY created_at DESC
+	`, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invites := make([]*models.Invite, 0)
+	for rows.Next() {
+		invite := &models.Invite{}
+		err := rows.Scan(
+			&invite.ID,
+			&invite.RoomID,
+			&invite.CreatedBy,
+			&invite.RecipientID,
+			&invite.MaxUses,
+			&invite.Uses,
+			&invite.ExpiresAt,
+			&invite.RevokedAt,
+			&invite.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		invites = append(invites, invite)
+	}
+	return invites, rows.Err()
+}
+
+func (s *PostgresInviteStore) RevokeInvite(roomID, id string) error {
+	result, err := s.db.Exec(`
+		UPDATE room_invites
+		SET revoked_at = COALESCE(revoked_at, now())
+		WHERE id = $1 AND room_id = $2
+	`, id, roomID)
+	if isInvalidUUID(err) {
+		return ErrInviteNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return ErrInviteNotFound
+	}
+	return nil
+}
+
+// RedeemInvite atomically uses up one join from an invite, failing if it is
+// no longer valid for userID.
+func (s *PostgresInviteStore) RedeemInvite(roomID, id, userID string) error {
+	result, err := s.db.Exec(`
+		UPDATE room_invites
+		SET uses = uses + 1
+		WHERE id = $1
+			AND room_id = $2
+			AND revoked_at IS NULL
+			AND expires_at > now()
+			AND uses < max_uses
+			AND (recipient_id = '' OR recipient_id = $3)
+	`, id, roomID, userID)
+	if isInvalidUUID(err) {
+		return ErrInviteUnusable
+	}
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return ErrInviteUnusable
+	}
+	return nil
+}
+
+// ReleaseInvite gives back a join RedeemInvite used up, for when the join
+// failed after all.
+func (s *PostgresInviteStore) ReleaseInvite(roomID, id string) error {
+	_, err := s.db.Exec(`
+		UPDATE room_invites
+		SET uses = uses - 1
+		WHERE id = $1 AND room_id = $2 AND uses > 0
+	`, id, roomID)
+	return err
+}
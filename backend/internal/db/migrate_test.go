@@ -0,0 +1,133 @@
+package db
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func sqlFile(body string) *fstest.MapFile {
+	return &fstest.MapFile{Data: []byte(body)}
+}
+
+func TestParseMigrations(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    fstest.MapFS
+		versions []int
+		err      string
+	}{
+		{
+			name:     "empty",
+			files:    fstest.MapFS{},
+			versions: []int{},
+		},
+		{
+			name: "orders by version, not file name",
+			files: fstest.MapFS{
+				"10_ten.up.sql":     sqlFile("up 10"),
+				"10_ten.down.sql":   sqlFile("down 10"),
+				"9_nine.up.sql":     sqlFile("up 9"),
+				"9_nine.down.sql":   sqlFile("down 9"),
+				"0002_two.up.sql":   sqlFile("up 2"),
+				"0002_two.down.sql": sqlFile("down 2"),
+			},
+			versions: []int{2, 9, 10},
+		},
+		{
+			name: "missing down file",
+			files: fstest.MapFS{
+				"0001_users.up.sql": sqlFile("up"),
+			},
+			err: "missing its up or down file",
+		},
+		{
+			name: "missing up file",
+			files: fstest.MapFS{
+				"0001_users.down.sql": sqlFile("down"),
+			},
+			err: "missing its up or down file",
+		},
+		{
+			name: "conflicting names",
+			files: fstest.MapFS{
+				"0001_users.up.sql":    sqlFile("up"),
+				"0001_people.down.sql": sqlFile("down"),
+			},
+			err: "conflicting names",
+		},
+		{
+			name: "bad file name",
+			files: fstest.MapFS{
+				"0001_users.sql": sqlFile("up"),
+			},
+			err: "invalid migration file name",
+		},
+		{
+			name: "name without version",
+			files: fstest.MapFS{
+				"users.up.sql": sqlFile("up"),
+			},
+			err: "invalid migration file name",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			migrations, err := parseMigrations(tt.files)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("err = %v, want it to contain %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(migrations) != len(tt.versions) {
+				t.Fatalf("got %d migrations, want %d", len(migrations), len(tt.versions))
+			}
+			for i, m := range migrations {
+				if m.Version != tt.versions[i] {
+					t.Errorf("migrations[%d].Version = %d, want %d", i, m.Version, tt.versions[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParseMigrationsBodies(t *testing.T) {
+	migrations, err := parseMigrations(fstest.MapFS{
+		"0003_add_profiles.up.sql":   sqlFile("ALTER TABLE users ADD x TEXT;"),
+		"0003_add_profiles.down.sql": sqlFile("ALTER TABLE users DROP x;"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Migration{
+		Version: 3,
+		Name:    "add_profiles",
+		Up:      "ALTER TABLE users ADD x TEXT;",
+		Down:    "ALTER TABLE users DROP x;",
+	}
+	if len(migrations) != 1 || migrations[0] != want {
+		t.Fatalf("got %+v, want %+v", migrations, want)
+	}
+}
+
+// The shipped migrations must load and have no gaps, since versions are
+// applied in order and a gap usually means a renumbering mistake.
+func TestEmbeddedMigrations(t *testing.T) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("no embedded migrations")
+	}
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Errorf("migration %d_%s has version %d, want %d", m.Version, m.Name, m.Version, i+1)
+		}
+	}
+}
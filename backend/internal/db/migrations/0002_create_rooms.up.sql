@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS rooms (
+	id VARCHAR(8) PRIMARY KEY,
+	name TEXT NOT NULL,
+	creator TEXT NOT NULL,
+	is_public BOOLEAN NOT NULL DEFAULT false,
+	password TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
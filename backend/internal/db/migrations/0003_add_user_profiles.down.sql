@@ -0,0 +1,5 @@
+ALTER TABLE users
+	DROP COLUMN username,
+	DROP COLUMN avatar_id,
+	DROP COLUMN created_at,
+	DROP COLUMN last_seen_at;
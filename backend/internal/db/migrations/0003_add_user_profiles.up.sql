@@ -0,0 +1,5 @@
+ALTER TABLE users
+	ADD COLUMN username TEXT NOT NULL DEFAULT '',
+	ADD COLUMN avatar_id TEXT NOT NULL DEFAULT '',
+	ADD COLUMN created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	ADD COLUMN last_seen_at TIMESTAMPTZ NOT NULL DEFAULT now();
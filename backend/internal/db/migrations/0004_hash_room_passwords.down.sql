@@ -0,0 +1,14 @@
+-- Hashes cannot be reversed, and the code before this migration compares
+-- the column as plaintext, so rolling back while any room has a hashed
+-- password would lock everyone out of it. This refuses to run until those
+-- passwords are cleared, e.g. with
+--   UPDATE rooms SET password_hash = '' WHERE password_hash LIKE '$2_$%';
+DO $$
+BEGIN
+	IF EXISTS (SELECT 1 FROM rooms WHERE password_hash LIKE '$2_$%') THEN
+		RAISE EXCEPTION 'rooms have hashed passwords, which cannot be rolled back; clear them first';
+	END IF;
+END
+$$;
+
+ALTER TABLE rooms RENAME COLUMN password_hash TO password;
@@ -0,0 +1,4 @@
+-- Existing plaintext passwords are hashed by the server when it starts,
+-- since hashing them here would need the pgcrypto extension and the
+-- rights to create it.
+ALTER TABLE rooms RENAME COLUMN password TO password_hash;
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS room_invites (
+	id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+	room_id VARCHAR(8) NOT NULL REFERENCES rooms (id) ON DELETE CASCADE,
+	created_by TEXT NOT NULL,
+	recipient_id TEXT NOT NULL DEFAULT '',
+	max_uses INTEGER NOT NULL,
+	uses INTEGER NOT NULL DEFAULT 0,
+	expires_at TIMESTAMPTZ NOT NULL,
+	revoked_at TIMESTAMPTZ,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS room_invites_room_id_idx ON room_invites (room_id);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS room_bans;
+DROP TABLE IF EXISTS room_roles;
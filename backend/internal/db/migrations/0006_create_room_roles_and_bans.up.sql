@@ -0,0 +1,16 @@
+-- Owners are the room creator and members are everyone else, so only
+-- promoted roles need a row.
+CREATE TABLE IF NOT EXISTS room_roles (
+	room_id VARCHAR(8) NOT NULL REFERENCES rooms (id) ON DELETE CASCADE,
+	user_id TEXT NOT NULL,
+	role TEXT NOT NULL CHECK (role IN ('moderator')),
+	PRIMARY KEY (room_id, user_id)
+);
+
+CREATE TABLE IF NOT EXISTS room_bans (
+	room_id VARCHAR(8) NOT NULL REFERENCES rooms (id) ON DELETE CASCADE,
+	user_id TEXT NOT NULL,
+	banned_by TEXT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	PRIMARY KEY (room_id, user_id)
+);
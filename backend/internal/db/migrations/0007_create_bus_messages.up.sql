@@ -0,0 +1,8 @@
+-- Bus payloads too large for a NOTIFY, which carries only their id
+CREATE TABLE IF NOT EXISTS bus_messages (
+	id BIGSERIAL PRIMARY KEY,
+	payload BYTEA NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS bus_messages_created_at_idx ON bus_messages (created_at);
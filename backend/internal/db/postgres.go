@@ -4,6 +4,8 @@ import (
 	"database/sql"
 
 	_ "github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 )
 
 type Database struct {
@@ -23,20 +25,12 @@ func NewDatabase(url string) (*Database, error) {
 	return &Database{db: db}, nil
 }
 
-func (d *Database) CreateUser() (string, error) {
-	var userID string
-	err := d.db.QueryRow(`
-		INSERT INTO users DEFAULT VALUES
-		RETURNING id
-	`).Scan(&userID)
-	return userID, err
+// StatsCollector exports the connection pool stats to Prometheus.
+func (d *Database) StatsCollector() prometheus.Collector {
+	return collectors.NewDBStatsCollector(d.db, "portal")
 }
 
-func (d *Database) InitializeTables() error {
-	_, err := d.db.Exec(`
-		CREATE TABLE IF NOT EXISTS users (
-			id UUID PRIMARY KEY DEFAULT gen_random_uuid()
-		)
-	`)
-	return err
+// Close closes the connection pool.
+func (d *Database) Close() error {
+	return d.db.Close()
 }
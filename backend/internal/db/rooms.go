@@ -0,0 +1,260 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"portal/internal/auth"
+	"portal/internal/models"
+
+	"github.com/gorilla/websocket"
+	"github.com/lib/pq"
+)
+
+var (
+	ErrRoomNotFound = errors.New("room not found")
+	ErrRoomExists   = errors.New("room already exists")
+)
+
+// RoomStore persists room metadata, promoted roles and bans. Live
+// membership is not stored and stays with the WebSocket server.
+type RoomStore interface {
+	CreateRoom(room *models.Room) error
+	GetRoom(id string) (*models.Room, error)
+	ListPublicRooms() ([]*models.Room, error)
+	UpdateRoom(room *models.Room) error
+	ReplacePasswordHash(roomID, oldHash, newHash string) error
+	SetRole(roomID, userID, role string) error
+	AddBan(roomID, userID, bannedBy string) error
+	RemoveBan(roomID, userID string) error
+}
+
+type PostgresRoomStore struct {
+	db *sql.DB
+}
+
+func NewPostgresRoomStore(database *Database) *PostgresRoomStore {
+	return &PostgresRoomStore{db: database.db}
+}
+
+func (s *PostgresRoomStore) CreateRoom(room *models.Room) error {
+	err := s.db.QueryRow(`
+		INSERT INTO rooms (id, name, creator, is_public, password_hash)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING created_at, updated_at
+	`, room.ID, room.Name, room.Creator, room.IsPublic, room.PasswordHash).Scan(&room.CreatedAt, &room.UpdatedAt)
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return ErrRoomExists
+	}
+	return err
+}
+
+func (s *PostgresRoomStore) GetRoom(id string) (*models.Room, error) {
+	room, err := scanRoom(s.db.QueryRow(`
+		SELECT id, name, creator, is_public, password_hash, created_at, updated_at
+		FROM rooms
+		WHERE id = $1
+	`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrRoomNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	room.Moderators, err = s.queryUserSet(`
+		SELECT user_id FROM room_roles WHERE room_id = $1 AND role = 'moderator'
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+
+	room.Bans, err = s.queryUserSet(`
+		SELECT user_id FROM room_bans WHERE room_id = $1
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+	return room, nil
+}
+
+func (s *PostgresRoomStore) ListPublicRooms() ([]*models.Room, error) {
+	rows, err := s.db.Query(`
+		SELECT id, name, creator, is_public, password_hash, created_at, updated_at
+		FROM rooms
+		WHERE is_public
+		ORDER BY created_at DESC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rooms := make([]*models.Room, 0)
+	for rows.Next() {
+		room, err := scanRoom(rows)
+		if err != nil {
+			return nil, err
+		}
+		rooms = append(rooms, room)
+	}
+	return rooms, rows.Err()
+}
+
+func (s *PostgresRoomStore) UpdateRoom(room *models.Room) error {
+	err := s.db.QueryRow(`
+		UPDATE rooms
+		SET name = $2, is_public = $3, password_hash = $4, updated_at = now()
+		WHERE id = $1
+		RETURNING updated_at
+	`, room.ID, room.Name, room.IsPublic, room.PasswordHash).Scan(&room.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrRoomNotFound
+	}
+	return err
+}
+
+// ReplacePasswordHash swaps a room's password hash for another of the same
+// password, unless it changed since oldHash was read, in which case it
+// returns ErrRoomNotFound. The room's settings are not otherwise touched.
+func (s *PostgresRoomStore) ReplacePasswordHash(roomID, oldHash, newHash string) error {
+	result, err := s.db.Exec(`
+		UPDATE rooms SET password_hash = $3
+		WHERE id = $1 AND password_hash = $2
+	`, roomID, oldHash, newHash)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrRoomNotFound
+	}
+	return err
+}
+
+// HashLegacyPasswords bcrypts room passwords still stored in plaintext from
+// before migration 0004 and returns how many it hashed. A password changed
+// while this runs is left to its new hash. Passwords too long for bcrypt
+// are logged and left alone; nobody can join with them until they are
+// reset.
+func (s *PostgresRoomStore) HashLegacyPasswords(cost int) (int, error) {
+	rows, err := s.db.Query(`
+		SELECT id, password_hash FROM rooms
+		WHERE password_hash <> '' AND password_hash NOT LIKE '$2_$%'
+	`)
+	if err != nil {
+		return 0, err
+	}
+	legacy := make(map[string]string)
+	for rows.Next() {
+		var id, password string
+		if err := rows.Scan(&id, &password); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		legacy[id] = password
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	hashed := 0
+	for id, password := range legacy {
+		if auth.IsHash(password) {
+			continue
+		}
+		hash, err := auth.HashPassword(password, cost)
+		if err != nil {
+			log.Printf("error hashing plaintext password of room %s, reset it: %v", id, err)
+			continue
+		}
+		err = s.ReplacePasswordHash(id, password, hash)
+		if errors.Is(err, ErrRoomNotFound) {
+			continue
+		}
+		if err != nil {
+			return hashed, err
+		}
+		hashed++
+	}
+	return hashed, nil
+}
+
+// SetRole stores a member's role. Setting RoleMember removes any promotion.
+func (s *PostgresRoomStore) SetRole(roomID, userID, role string) error {
+	if role == models.RoleMember {
+		_, err := s.db.Exec(`
+			DELETE FROM room_roles WHERE room_id = $1 AND user_id = $2
+		`, roomID, userID)
+		return err
+	}
+
+	_, err := s.db.Exec(`
+		INSERT INTO room_roles (room_id, user_id, role)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (room_id, user_id) DO UPDATE SET role = EXCLUDED.role
+	`, roomID, userID, role)
+	return err
+}
+
+func (s *PostgresRoomStore) AddBan(roomID, userID, bannedBy string) error {
+	_, err := s.db.Exec(`
+		INSERT INTO room_bans (room_id, user_id, banned_by)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (room_id, user_id) DO NOTHING
+	`, roomID, userID, bannedBy)
+	return err
+}
+
+func (s *PostgresRoomStore) RemoveBan(roomID, userID string) error {
+	_, err := s.db.Exec(`
+		DELETE FROM room_bans WHERE room_id = $1 AND user_id = $2
+	`, roomID, userID)
+	return err
+}
+
+func (s *PostgresRoomStore) queryUserSet(query string, args ...interface{}) (map[string]bool, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := make(map[string]bool)
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		users[userID] = true
+	}
+	return users, rows.Err()
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanRoom(row rowScanner) (*models.Room, error) {
+	room := &models.Room{
+		Members:    make(map[*websocket.Conn]string),
+		Moderators: make(map[string]bool),
+		Bans:       make(map[string]bool),
+		Muted:      make(map[string]bool),
+	}
+	err := row.Scan(
+		&room.ID,
+		&room.Name,
+		&room.Creator,
+		&room.IsPublic,
+		&room.PasswordHash,
+		&room.CreatedAt,
+		&room.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return room, nil
+}
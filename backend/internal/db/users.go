@@ -0,0 +1,89 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"portal/internal/models"
+
+	"github.com/lib/pq"
+)
+
+var ErrUserNotFound = errors.New("user not found")
+
+// UserStore persists user profiles.
+type UserStore interface {
+	CreateUser() (string, error)
+	GetUser(id string) (*models.User, error)
+	UpdateUser(user *models.User) error
+	TouchUser(id string) error
+}
+
+type PostgresUserStore struct {
+	db *sql.DB
+}
+
+func NewPostgresUserStore(database *Database) *PostgresUserStore {
+	return &PostgresUserStore{db: database.db}
+}
+
+func (s *PostgresUserStore) CreateUser() (string, error) {
+	var userID string
+	err := s.db.QueryRow(`
+		INSERT INTO users DEFAULT VALUES
+		RETURNING id
+	`).Scan(&userID)
+	return userID, err
+}
+
+func (s *PostgresUserStore) GetUser(id string) (*models.User, error) {
+	user := &models.User{}
+	err := s.db.QueryRow(`
+		SELECT id, username, avatar_id, created_at, last_seen_at
+		FROM users
+		WHERE id = $1
+	`, id).Scan(&user.ID, &user.Username, &user.AvatarID, &user.CreatedAt, &user.LastSeenAt)
+	if errors.Is(err, sql.ErrNoRows) || isInvalidUUID(err) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (s *PostgresUserStore) UpdateUser(user *models.User) error {
+	err := s.db.QueryRow(`
+		UPDATE users
+		SET username = $2, avatar_id = $3
+		WHERE id = $1
+		RETURNING created_at, last_seen_at
+	`, user.ID, user.Username, user.AvatarID).Scan(&user.CreatedAt, &user.LastSeenAt)
+	if errors.Is(err, sql.ErrNoRows) || isInvalidUUID(err) {
+		return ErrUserNotFound
+	}
+	return err
+}
+
+// TouchUser bumps last_seen_at for a user.
+func (s *PostgresUserStore) TouchUser(id string) error {
+	result, err := s.db.Exec(`
+		UPDATE users SET last_seen_at = now() WHERE id = $1
+	`, id)
+	if isInvalidUUID(err) {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// isInvalidUUID reports whether err is Postgres rejecting a malformed UUID,
+// which for lookups by ID is the same as the user not existing.
+func isInvalidUUID(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "22P02"
+}
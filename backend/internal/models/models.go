@@ -1,47 +1,264 @@
 package models
 
-import "github.com/gorilla/websocket"
+import (
+	"portal/internal/codec"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
 
 type User struct {
-	ID string // Unique user identifier
+	ID         string    // Unique user identifier
+	Username   string    // Display name
+	AvatarID   string    // Avatar identifier
+	CreatedAt  time.Time // When the user was created
+	LastSeenAt time.Time // Last time the user joined or left a room
 }
 
 type Room struct {
-	ID       string                     // Unique room identifier
-	Name     string                     // Room name (e.g., FluffyCookie)
-	Creator  string                     // ID of the room creator
-	IsPublic bool                       // Visibility (true = public, false = private)
-	Password string                     // Password for private rooms
-	Members  map[*websocket.Conn]string // Map of WebSocket connections to usernames
+	ID           string                     // Unique room identifier
+	Name         string                     // Room name (e.g., FluffyCookie)
+	Creator      string                     // ID of the room creator
+	IsPublic     bool                       // Visibility (true = public, false = private)
+	PasswordHash string                     // bcrypt hash of the password for private rooms, empty if unset
+	Members      map[*websocket.Conn]string // Map of WebSocket connections to usernames
+	Moderators   map[string]bool            // IDs of users promoted to moderator
+	Bans         map[string]bool            // IDs of users banned from the room
+	Muted        map[string]bool            // IDs of users muted while the room is live
+
+	CreatedAt time.Time // When the room was first persisted
+	UpdatedAt time.Time // Last time the room settings changed
 }
 
+type Invite struct {
+	ID          string     // Unique invite identifier
+	RoomID      string     // Room the invite grants access to
+	CreatedBy   string     // ID of the user who minted the invite
+	RecipientID string     // If set, the only user who may redeem it
+	MaxUses     int        // How many joins the invite allows
+	Uses        int        // How many joins it has been used for
+	ExpiresAt   time.Time  // When the invite stops working
+	RevokedAt   *time.Time // When the invite was revoked, nil if active
+	CreatedAt   time.Time  // When the invite was minted
+}
+
+// Member roles, from most to least privileged. The creator is always the
+// owner.
+const (
+	RoleOwner     = "owner"
+	RoleModerator = "moderator"
+	RoleMember    = "member"
+)
+
 type Client struct {
-	Conn     *websocket.Conn // WebSocket connection
-	UserID   string          // Unique user identifier
-	Username string          // Username
-	AvatarID string          // Avatar identifier
-	RoomIDs  []string        // Rooms the user is connected to
+	Conn            *websocket.Conn // WebSocket connection
+	IP              string          // Remote IP the connection came from
+	UserID          string          // Unique user identifier
+	Username        string          // Username
+	AvatarID        string          // Avatar identifier
+	RoomIDs         []string        // Rooms the user is connected to
+	ProtocolVersion int             // Negotiated protocol version
+	Capabilities    map[string]bool // Features both sides agreed on in the handshake
+	Codec           codec.Codec     // Encoding negotiated through the subprotocol
+	ResumeToken     string          // Lets a new connection take over this session
+	ConnectedAt     time.Time       // When the connection was accepted
+	Presence        string          // PresenceOnline, PresenceIdle or PresenceAway
+	Outbox          Outbox          // Queues messages for the connection's writer
+}
+
+// Outbox queues messages for a client. A single writer delivers them in
+// order, so nothing else may write to the client's connection.
+type Outbox interface {
+	// Send queues msgs in order. Each one that does not fit the queue is
+	// subject to the slow client policy on its own.
+	Send(msgs ...Message)
+	// Close delivers everything already queued, then closes the
+	// connection with code and reason.
+	Close(code int, reason string)
+	// Done is closed once the writer has stopped and the connection is
+	// closed or failing.
+	Done() <-chan struct{}
 }
 
+// Member presence. Idle members are connected but have sent nothing for a
+// while; away members lost their connection or said they stepped away.
+const (
+	PresenceOnline = "online"
+	PresenceIdle   = "idle"
+	PresenceAway   = "away"
+)
+
+// Message is the envelope for everything sent over the WebSocket. A client
+// may set ID on a request; the server copies it onto the ack, error or
+// other reply to that request so the two can be matched up.
 type Message struct {
+	ID      string      `json:"id,omitempty"`
 	Type    string      `json:"type"`
 	RoomID  string      `json:"roomId,omitempty"`
 	UserID  string      `json:"userId,omitempty"`
 	Payload interface{} `json:"payload,omitempty"`
 }
 
-// Add these new message types
+// Protocol versions the server speaks. Clients that never send hello are
+// assumed to speak MinProtocolVersion, which is the protocol as it was
+// before the handshake existed.
+const (
+	ProtocolVersion    = 1
+	MinProtocolVersion = 1
+)
+
+// CloseUnsupportedVersion is the WebSocket close code sent when the client
+// and server share no protocol version.
+const CloseUnsupportedVersion = 4001
+
+// CloseSlowConsumer is the WebSocket close code sent when a client reads
+// too slowly to keep up with its send queue.
+const CloseSlowConsumer = 4002
+
+// CloseSessionReplaced is the WebSocket close code sent, after
+// MessageSessionReplaced, to a connection the same user took over from
+// somewhere else. Clients should not reconnect on their own.
+const CloseSessionReplaced = 4003
+
+// CloseSessionRejected is the WebSocket close code sent, after an
+// ErrCodeSessionActive error, to a connection refused because the user is
+// already connected.
+const CloseSessionRejected = 4004
+
+// MessageHello may be sent by a client as its first message to negotiate
+// the protocol. Its payload is a HelloPayload and the server answers with
+// MessageWelcome.
+const (
+	MessageHello   = "hello"
+	MessageWelcome = "welcome"
+)
+
+// HelloPayload declares the newest protocol version a client speaks, the
+// oldest it still accepts and the features it understands.
+type HelloPayload struct {
+	Version      int      `json:"version" validate:"required,min=1"`
+	MinVersion   int      `json:"minVersion,omitempty" validate:"omitempty,min=1"`
+	Capabilities []string `json:"capabilities,omitempty" validate:"max=32,dive,max=64"`
+}
+
+// WelcomePayload tells the client which version was picked, what the
+// server supports and which of the client's capabilities it accepted.
+type WelcomePayload struct {
+	Version      int            `json:"version"`
+	MinVersion   int            `json:"minVersion"`
+	MaxVersion   int            `json:"maxVersion"`
+	Features     []string       `json:"features"`
+	Capabilities []string       `json:"capabilities"`
+	Limits       ProtocolLimits `json:"limits"`
+}
+
+// ProtocolLimits are the size limits the server enforces, in bytes.
+type ProtocolLimits struct {
+	MaxMessageSize     int `json:"maxMessageSize"`
+	MaxSDPLength       int `json:"maxSdpLength"`
+	MaxCandidateLength int `json:"maxCandidateLength"`
+	MaxUsernameLength  int `json:"maxUsernameLength"`
+	MaxPasswordLength  int `json:"maxPasswordLength"`
+}
+
+// MessageAck is sent once a state-changing request (create_room, join_room,
+// leave_room, signals and moderation commands) has taken effect. Its
+// payload is an AckPayload.
+const MessageAck = "ack"
+
+// AckPayload names the request type being acknowledged.
+type AckPayload struct {
+	Type string `json:"type"`
+}
+
+// MessageError is sent when a request fails. Its payload is an
+// ErrorPayload.
+const MessageError = "error"
+
+// ErrorPayload describes a failed request. Clients should branch on Code;
+// Message is meant for people and its wording may change.
+type ErrorPayload struct {
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+// FieldError reports one payload field that failed validation, naming the
+// rule it broke and the rule's parameter, if any.
+type FieldError struct {
+	Field string `json:"field"`
+	Rule  string `json:"rule"`
+	Param string `json:"param,omitempty"`
+}
+
+// Error codes sent in ErrorPayload.Code. Details are only set where noted.
+const (
+	ErrCodeInvalidMessage     = "invalid_message"     // The frame is not a valid message
+	ErrCodeUnsupportedVersion = "unsupported_version" // Details: {minVersion, maxVersion}; the connection is closed
+	ErrCodeUnknownType        = "unknown_type"        // The message type is not recognised
+	ErrCodeInvalidPayload     = "invalid_payload"     // Details: {fields} when the payload failed validation
+	ErrCodeIdentityMismatch   = "identity_mismatch"   // userId does not match the session
+	ErrCodeInvalidRoomID      = "invalid_room_id"     // The room ID is not 8 letters or digits
+	ErrCodeInvalidUsername    = "invalid_username"    // The username is missing or invalid
+	ErrCodeInvalidAvatar      = "invalid_avatar"      // The avatar ID is missing or unknown
+	ErrCodeRoomExists         = "room_exists"         // create_room named a taken room ID
+	ErrCodeBanned             = "banned"              // The user is banned from the room
+	ErrCodeInvalidInvite      = "invalid_invite"      // The invite is invalid, expired or used up
+	ErrCodeInvalidPassword    = "invalid_password"    // The room password is wrong
+	ErrCodeJoinLockedOut      = "join_locked_out"     // Details: {retryAfter} in seconds
+	ErrCodePasswordTooLong    = "password_too_long"   // Details: {maxLength} in bytes
+	ErrCodeNotInRoom          = "not_in_room"         // The sender has not joined the room
+	ErrCodeTargetNotInRoom    = "target_not_in_room"  // The addressed user is not in the room
+	ErrCodeMuted              = "muted"               // The sender is muted in the room
+	ErrCodeInvalidSignal      = "invalid_signal"      // A signal failed validation
+	ErrCodeForbidden          = "forbidden"           // The sender's role does not allow this
+	ErrCodeResumeFailed       = "resume_failed"       // The session expired or belongs to someone else
+	ErrCodeSessionActive      = "session_active"      // The user is already connected elsewhere; the connection is closed
+	ErrCodeInternal           = "internal_error"      // The server failed; retrying may work
+)
+
+// Typed signaling message types. The payload is a SignalingPayload whose
+// Type is "offer", "answer" or "candidate" to match.
 const (
 	SignalOffer     = "signal_offer"
 	SignalAnswer    = "signal_answer"
 	SignalCandidate = "signal_candidate"
 )
 
-// Add SignalingPayload struct
+// SignalingPayload is forwarded between peers. FromUserID is always set by
+// the server; a missing ToUserID broadcasts to the whole room.
 type SignalingPayload struct {
-	Type       string      `json:"type"`
-	SDP        string      `json:"sdp,omitempty"`
-	Candidate  interface{} `json:"candidate,omitempty"`
-	FromUserID string      `json:"fromUserId"`
-	ToUserID   string      `json:"toUserId,omitempty"`
+	Type       string        `json:"type"`
+	SDP        string        `json:"sdp,omitempty" validate:"max=65536"`
+	Candidate  *ICECandidate `json:"candidate,omitempty"`
+	FromUserID string        `json:"fromUserId"`
+	ToUserID   string        `json:"toUserId,omitempty"`
+}
+
+// SignalCandidates is sent instead of several queued signal_candidate
+// messages from one peer when a slow client has fallen behind. Only clients
+// with the candidate_batches capability receive it.
+const SignalCandidates = "signal_candidates"
+
+// CandidateBatchPayload holds a peer's candidates in the order it sent
+// them.
+type CandidateBatchPayload struct {
+	FromUserID string         `json:"fromUserId"`
+	Candidates []ICECandidate `json:"candidates"`
+}
+
+// ICEServer mirrors the browser's RTCIceServer dictionary.
+type ICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// ICECandidate mirrors RTCIceCandidateInit. An empty Candidate marks the
+// end of candidates.
+type ICECandidate struct {
+	Candidate        string  `json:"candidate" validate:"max=4096"`
+	SDPMid           *string `json:"sdpMid,omitempty" validate:"omitempty,max=256"`
+	SDPMLineIndex    *int    `json:"sdpMLineIndex,omitempty" validate:"omitempty,min=0"`
+	UsernameFragment *string `json:"usernameFragment,omitempty" validate:"omitempty,max=256"`
 }
@@ -0,0 +1,182 @@
+package models
+
+// Message types sent by clients. Each has a payload struct below, except
+// leave_room which takes none.
+const (
+	MessageResume        = "resume"
+	MessageSetPresence   = "set_presence"
+	MessageJoinRoom      = "join_room"
+	MessageCreateRoom    = "create_room"
+	MessageLeaveRoom     = "leave_room"
+	MessageSignal        = "signal" // Deprecated, see LegacySignalPayload
+	MessageKickMember    = "kick_member"
+	MessageBanMember     = "ban_member"
+	MessageUnbanMember   = "unban_member"
+	MessagePromoteMember = "promote_member"
+	MessageMuteMember    = "mute_member"
+)
+
+// Message types sent by the server, besides welcome, ack, error and the
+// forwarded signals.
+const (
+	MessageSessionResumed     = "session_resumed"
+	MessageRoomNotFound       = "room_not_found"
+	MessageRoomJoined         = "room_joined"
+	MessageRoomCreated        = "room_created"
+	MessageUserJoined         = "user_joined"
+	MessageUserLeft           = "user_left"
+	MessageMemberKicked       = "member_kicked"
+	MessageMemberUnbanned     = "member_unbanned"
+	MessageRoleChanged        = "role_changed"
+	MessageMemberMuted        = "member_muted"
+	MessageJoinAttemptsFailed = "join_attempts_failed"
+	MessagePresenceChanged    = "presence_changed"
+	MessageServerShutdown     = "server_shutdown"
+	MessageSessionReplaced    = "session_replaced"
+)
+
+// ResumePayload takes over a session that lost its connection, using the
+// token from room_joined. It must be sent before joining any room.
+type ResumePayload struct {
+	Token string `json:"token" validate:"required,max=64"`
+}
+
+// SessionResumedPayload lists the rooms the resumed session is still in.
+// The Missed messages follow it; Dropped more were lost because the buffer
+// filled up, so peer connections may need renegotiating.
+type SessionResumedPayload struct {
+	RoomIDs []string `json:"roomIds"`
+	Missed  int      `json:"missed"`
+	Dropped int      `json:"dropped"`
+}
+
+// ServerShutdownPayload is sent just before the server closes the
+// connection with 1012 (service restart) to shut down. Clients should wait
+// ReconnectAfter milliseconds, then reconnect and resume.
+type ServerShutdownPayload struct {
+	ReconnectAfter int `json:"reconnectAfter"`
+}
+
+// SetPresencePayload is sent by a client going away, for example when its
+// tab is hidden, or coming back.
+type SetPresencePayload struct {
+	Presence string `json:"presence" validate:"required,oneof=online away"`
+}
+
+// JoinRoomPayload asks to join the room named by the message's roomId.
+// Username and AvatarID fall back to the stored profile when empty. Private
+// rooms need either the password or an invite token.
+type JoinRoomPayload struct {
+	Password    string `json:"password,omitempty"`
+	InviteToken string `json:"inviteToken,omitempty" validate:"max=1024"`
+	Username    string `json:"username,omitempty"`
+	AvatarID    string `json:"avatarId,omitempty"`
+}
+
+// CreateRoomPayload creates a room with the message's roomId, or a
+// generated one if it is empty. An empty Name is generated too.
+type CreateRoomPayload struct {
+	Name     string `json:"name,omitempty"`
+	IsPublic bool   `json:"isPublic"`
+	Password string `json:"password,omitempty"`
+}
+
+// LegacySignalPayload is forwarded untouched by the deprecated signal
+// message. Only toUserId is read by the server.
+type LegacySignalPayload map[string]interface{}
+
+// MemberPayload names the member a kick_member, ban_member or unban_member
+// command acts on.
+type MemberPayload struct {
+	UserID string `json:"userId" validate:"required"`
+}
+
+// PromoteMemberPayload sets a member's role. Only the owner may send it.
+type PromoteMemberPayload struct {
+	UserID string `json:"userId" validate:"required"`
+	Role   string `json:"role" validate:"required,oneof=moderator member"`
+}
+
+// MuteMemberPayload mutes or unmutes a member. Muted defaults to true.
+type MuteMemberPayload struct {
+	UserID string `json:"userId" validate:"required"`
+	Muted  *bool  `json:"muted,omitempty"`
+}
+
+// MemberInfo describes a room member. Role and Presence are omitted from
+// user_left.
+type MemberInfo struct {
+	UserID   string `json:"userId"`
+	Username string `json:"username"`
+	AvatarID string `json:"avatarId"`
+	Role     string `json:"role,omitempty"`
+	Presence string `json:"presence,omitempty"`
+}
+
+// RoomNotFoundPayload answers a join for a room that does not exist yet.
+type RoomNotFoundPayload struct {
+	SuggestedName string `json:"suggestedName"`
+	CreateRoom    bool   `json:"createRoom"`
+}
+
+// RoomJoinedPayload is sent to a member who just joined, listing everyone
+// in the room including themselves. ResumeToken is the same for every room
+// joined on a connection.
+type RoomJoinedPayload struct {
+	Members     []MemberInfo `json:"members"`
+	Name        string       `json:"name"`
+	IsPublic    bool         `json:"isPublic"`
+	ICEServers  []ICEServer  `json:"iceServers"`
+	ResumeToken string       `json:"resumeToken"`
+}
+
+type RoomCreatedPayload struct {
+	Name     string `json:"name"`
+	IsPublic bool   `json:"isPublic"`
+	Creator  string `json:"creator"`
+}
+
+// UserJoinedPayload is sent to the other members when someone joins.
+type UserJoinedPayload struct {
+	User MemberInfo `json:"user"`
+	Name string     `json:"name"`
+}
+
+// MemberKickedPayload is sent to the room, including the kicked member,
+// when someone is kicked or banned.
+type MemberKickedPayload struct {
+	UserID string `json:"userId"`
+	By     string `json:"by"`
+	Banned bool   `json:"banned"`
+}
+
+type MemberUnbannedPayload struct {
+	UserID string `json:"userId"`
+	By     string `json:"by"`
+}
+
+type RoleChangedPayload struct {
+	UserID string `json:"userId"`
+	Role   string `json:"role"`
+	By     string `json:"by"`
+}
+
+type MemberMutedPayload struct {
+	UserID string `json:"userId"`
+	Muted  bool   `json:"muted"`
+	By     string `json:"by"`
+}
+
+// PresenceChangedPayload is sent to a room when a member's presence
+// changes.
+type PresenceChangedPayload struct {
+	UserID   string `json:"userId"`
+	Presence string `json:"presence"`
+}
+
+// JoinAttemptsFailedPayload warns a room's creator that failed password
+// attempts triggered a lockout.
+type JoinAttemptsFailedPayload struct {
+	Failures   int  `json:"failures"`
+	RoomLocked bool `json:"roomLocked"`
+}
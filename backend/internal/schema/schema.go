@@ -0,0 +1,213 @@
+// Package schema generates a JSON Schema document for the WebSocket
+// protocol from the Go types that implement it. Property names come from
+// json tags and constraints from validate tags.
+package schema
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Message describes one message type and who may send it.
+type Message struct {
+	Type       string
+	Payload    reflect.Type // Nil if the message has no payload
+	FromClient bool
+	FromServer bool
+}
+
+// Generate returns a draft 2020-12 schema whose root accepts any message.
+// Envelope is the struct every message is wrapped in; its "type" and
+// "payload" properties are narrowed for each message. The $defs also hold
+// ClientMessage and ServerMessage unions for each direction.
+func Generate(title string, envelope reflect.Type, messages []Message) map[string]interface{} {
+	g := &generator{defs: make(map[string]interface{})}
+
+	var all, fromClient, fromServer []interface{}
+	for _, msg := range messages {
+		name := messageName(msg.Type)
+		g.defs[name] = g.message(envelope, msg)
+
+		ref := map[string]interface{}{"$ref": "#/$defs/" + name}
+		all = append(all, ref)
+		if msg.FromClient {
+			fromClient = append(fromClient, ref)
+		}
+		if msg.FromServer {
+			fromServer = append(fromServer, ref)
+		}
+	}
+	g.defs["ClientMessage"] = map[string]interface{}{"oneOf": fromClient}
+	g.defs["ServerMessage"] = map[string]interface{}{"oneOf": fromServer}
+
+	return map[string]interface{}{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"title":   title,
+		"oneOf":   all,
+		"$defs":   g.defs,
+	}
+}
+
+type generator struct {
+	defs map[string]interface{}
+}
+
+// message narrows the envelope schema to a single message type.
+func (g *generator) message(envelope reflect.Type, msg Message) map[string]interface{} {
+	schema := g.object(envelope)
+	properties := schema["properties"].(map[string]interface{})
+	properties["type"] = map[string]interface{}{"const": msg.Type}
+
+	required := []string{"type"}
+	if msg.Payload != nil {
+		properties["payload"] = g.schemaFor(msg.Payload)
+		required = append(required, "payload")
+	} else {
+		delete(properties, "payload")
+	}
+	schema["required"] = required
+	return schema
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func (g *generator) schemaFor(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": g.schemaFor(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.schemaFor(t.Elem())}
+	case reflect.Struct:
+		if t == timeType {
+			return map[string]interface{}{"type": "string", "format": "date-time"}
+		}
+		if t.Name() == "" {
+			return g.object(t)
+		}
+		if _, exists := g.defs[t.Name()]; !exists {
+			g.defs[t.Name()] = nil // Reserve the name in case the type refers to itself
+			g.defs[t.Name()] = g.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/$defs/" + t.Name()}
+	default:
+		// interface{} accepts anything
+		return map[string]interface{}{}
+	}
+}
+
+func (g *generator) object(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	var required []string
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		schema := g.schemaFor(field.Type)
+		rules := strings.Split(field.Tag.Get("validate"), ",")
+		for i, rule := range rules {
+			if rule == "required" {
+				required = append(required, name)
+			}
+			if rule == "dive" {
+				if items, ok := schema["items"].(map[string]interface{}); ok {
+					applyRules(items, rules[i+1:])
+				}
+				break
+			}
+			applyRules(schema, []string{rule})
+		}
+		properties[name] = schema
+	}
+
+	schema := map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// applyRules translates the validate rules that have a JSON Schema
+// equivalent. References are left alone since their target is shared.
+func applyRules(schema map[string]interface{}, rules []string) {
+	if _, isRef := schema["$ref"]; isRef {
+		return
+	}
+
+	for _, rule := range rules {
+		key, param, _ := strings.Cut(rule, "=")
+		switch key {
+		case "min", "max":
+			n, err := strconv.Atoi(param)
+			if err != nil {
+				continue
+			}
+			schema[boundKeyword(schema["type"], key)] = n
+		case "oneof":
+			values := make([]interface{}, 0)
+			for _, value := range strings.Fields(param) {
+				values = append(values, value)
+			}
+			schema["enum"] = values
+		}
+	}
+}
+
+// boundKeyword picks the keyword a min or max rule maps to, which depends
+// on what it bounds.
+func boundKeyword(schemaType interface{}, rule string) string {
+	switch schemaType {
+	case "string":
+		return rule + "Length"
+	case "array":
+		return rule + "Items"
+	case "object":
+		return rule + "Properties"
+	}
+	if rule == "min" {
+		return "minimum"
+	}
+	return "maximum"
+}
+
+// messageName turns a message type such as join_room into JoinRoomMessage.
+func messageName(messageType string) string {
+	var b strings.Builder
+	for _, part := range strings.Split(messageType, "_") {
+		if part != "" {
+			b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+		}
+	}
+	b.WriteString("Message")
+	return b.String()
+}
@@ -0,0 +1,102 @@
+package schema
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type envelope struct {
+	Type    string      `json:"type"`
+	RoomID  string      `json:"roomId,omitempty"`
+	Payload interface{} `json:"payload,omitempty"`
+}
+
+type greeting struct {
+	Version int       `json:"version" validate:"required,min=1"`
+	Tags    []string  `json:"tags,omitempty" validate:"max=4,dive,max=8"`
+	Mood    string    `json:"mood" validate:"oneof=happy sad"`
+	Note    string    `json:"note" validate:"max=10"`
+	Limits  []int     `json:"limits" validate:"min=1"`
+	At      time.Time `json:"at"`
+	Count   uint      `json:"count"`
+	Next    *greeting `json:"next,omitempty"`
+	Ignored string    `json:"-"`
+	hidden  string
+}
+
+func TestGenerate(t *testing.T) {
+	doc := Generate("Test", reflect.TypeOf(envelope{}), []Message{
+		{Type: "say_hello", Payload: reflect.TypeOf(greeting{}), FromClient: true},
+		{Type: "leave", FromClient: true, FromServer: true},
+		{Type: "welcome", Payload: reflect.TypeOf(greeting{}), FromServer: true},
+	})
+	// Compare as JSON, the way it is served
+	data, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var root map[string]interface{}
+	json.Unmarshal(data, &root)
+	defs := root["$defs"].(map[string]interface{})
+
+	tests := []struct {
+		name string
+		path []string
+		want string
+	}{
+		{name: "root accepts every message", path: []string{"oneOf"},
+			want: `[{"$ref":"#/$defs/SayHelloMessage"},{"$ref":"#/$defs/LeaveMessage"},{"$ref":"#/$defs/WelcomeMessage"}]`},
+		{name: "client union", path: []string{"$defs", "ClientMessage", "oneOf"},
+			want: `[{"$ref":"#/$defs/SayHelloMessage"},{"$ref":"#/$defs/LeaveMessage"}]`},
+		{name: "server union", path: []string{"$defs", "ServerMessage", "oneOf"},
+			want: `[{"$ref":"#/$defs/LeaveMessage"},{"$ref":"#/$defs/WelcomeMessage"}]`},
+
+		{name: "type is pinned", path: []string{"$defs", "SayHelloMessage", "properties", "type"}, want: `{"const":"say_hello"}`},
+		{name: "payload is required", path: []string{"$defs", "SayHelloMessage", "required"}, want: `["type","payload"]`},
+		{name: "payload refers to its struct", path: []string{"$defs", "SayHelloMessage", "properties", "payload"}, want: `{"$ref":"#/$defs/greeting"}`},
+		{name: "no payload", path: []string{"$defs", "LeaveMessage", "properties"},
+			want: `{"roomId":{"type":"string"},"type":{"const":"leave"}}`},
+		{name: "closed objects", path: []string{"$defs", "greeting", "additionalProperties"}, want: `false`},
+
+		{name: "required fields", path: []string{"$defs", "greeting", "required"}, want: `["version"]`},
+		{name: "integer minimum", path: []string{"$defs", "greeting", "properties", "version"}, want: `{"minimum":1,"type":"integer"}`},
+		{name: "array and item bounds", path: []string{"$defs", "greeting", "properties", "tags"},
+			want: `{"items":{"maxLength":8,"type":"string"},"maxItems":4,"type":"array"}`},
+		{name: "min items", path: []string{"$defs", "greeting", "properties", "limits"}, want: `{"items":{"type":"integer"},"minItems":1,"type":"array"}`},
+		{name: "enum", path: []string{"$defs", "greeting", "properties", "mood"}, want: `{"enum":["happy","sad"],"type":"string"}`},
+		{name: "string length", path: []string{"$defs", "greeting", "properties", "note"}, want: `{"maxLength":10,"type":"string"}`},
+		{name: "time", path: []string{"$defs", "greeting", "properties", "at"}, want: `{"format":"date-time","type":"string"}`},
+		{name: "unsigned", path: []string{"$defs", "greeting", "properties", "count"}, want: `{"minimum":0,"type":"integer"}`},
+		{name: "self reference", path: []string{"$defs", "greeting", "properties", "next"}, want: `{"$ref":"#/$defs/greeting"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var node interface{} = root
+			for _, key := range tt.path {
+				object, ok := node.(map[string]interface{})
+				if !ok {
+					t.Fatalf("%v: %s is not inside an object", tt.path, key)
+				}
+				node = object[key]
+			}
+			got, _ := json.Marshal(node)
+			var want interface{}
+			if err := json.Unmarshal([]byte(tt.want), &want); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(node, want) {
+				t.Errorf("%v = %s, want %s", tt.path, got, tt.want)
+			}
+		})
+	}
+
+	properties := defs["greeting"].(map[string]interface{})["properties"].(map[string]interface{})
+	for _, skipped := range []string{"Ignored", "-", "hidden"} {
+		if _, exists := properties[skipped]; exists {
+			t.Errorf("property %q should be left out", skipped)
+		}
+	}
+}
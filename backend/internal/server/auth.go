@@ -0,0 +1,85 @@
+package server
+
+import (
+	"net/http"
+	"portal/internal/auth"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const userIDKey = "userID"
+
+// requireAuth rejects requests without a valid session token and stores the
+// authenticated user ID on the context.
+func (s *Server) requireAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, err := s.keys.Verify(sessionToken(c), auth.PurposeSession)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"error": "Invalid or expired session",
+			})
+			return
+		}
+
+		c.Set(userIDKey, claims.Subject)
+		c.Next()
+	}
+}
+
+// tokenSubprotocolPrefix marks the Sec-WebSocket-Protocol entry carrying
+// the session token, since browsers cannot set headers on WebSocket
+// upgrades. It is never selected, so clients offer a codec subprotocol
+// alongside it.
+const tokenSubprotocolPrefix = "portal.token."
+
+// sessionToken reads the bearer token from the Authorization header.
+func sessionToken(c *gin.Context) string {
+	token, found := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !found {
+		return ""
+	}
+	return token
+}
+
+// websocketToken reads the session token of a WebSocket upgrade from the
+// Authorization header, or else from the subprotocols offered. Tokens are
+// kept out of the URL so they do not end up in access logs.
+func websocketToken(c *gin.Context) string {
+	if token := sessionToken(c); token != "" {
+		return token
+	}
+	for _, protocol := range websocket.Subprotocols(c.Request) {
+		if token, found := strings.CutPrefix(protocol, tokenSubprotocolPrefix); found {
+			return token
+		}
+	}
+	return ""
+}
+
+// currentUserID returns the user authenticated by requireAuth.
+func currentUserID(c *gin.Context) string {
+	return c.GetString(userIDKey)
+}
+
+// issueSession responds with a fresh session token for userID.
+func (s *Server) issueSession(c *gin.Context, status int, userID string) {
+	token, expiresAt, err := s.keys.Issue(userID, auth.PurposeSession, s.config.SessionTTL)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to issue session",
+		})
+		return
+	}
+
+	c.JSON(status, gin.H{
+		"userId":    userID,
+		"token":     token,
+		"expiresAt": expiresAt,
+	})
+}
+
+func (s *Server) RefreshSession(c *gin.Context) {
+	s.issueSession(c, http.StatusOK, currentUserID(c))
+}
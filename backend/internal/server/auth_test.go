@@ -0,0 +1,43 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestWebsocketToken(t *testing.T) {
+	tests := []struct {
+		name          string
+		authorization string
+		protocols     string
+		query         string
+		want          string
+	}{
+		{name: "bearer header", authorization: "Bearer abc", want: "abc"},
+		{name: "subprotocol", protocols: "portal.json, portal.token.abc", want: "abc"},
+		{name: "header wins", authorization: "Bearer abc", protocols: "portal.token.def", want: "abc"},
+		{name: "other scheme", authorization: "Basic abc", want: ""},
+		{name: "codec only", protocols: "portal.msgpack", want: ""},
+		{name: "query is ignored", query: "?token=abc", want: ""},
+		{name: "nothing", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest("GET", "/ws"+tt.query, nil)
+			if tt.authorization != "" {
+				c.Request.Header.Set("Authorization", tt.authorization)
+			}
+			if tt.protocols != "" {
+				c.Request.Header.Set("Sec-WebSocket-Protocol", tt.protocols)
+			}
+
+			if got := websocketToken(c); got != tt.want {
+				t.Errorf("websocketToken() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,659 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"portal/internal/models"
+	"sync"
+	"time"
+)
+
+// Cluster event kinds.
+const (
+	// A message for a room's members, or just UserID's, on every
+	// instance. Room messages also keep the remote rosters up to date.
+	eventDeliver = "deliver"
+	// An instance dropped a member without telling the room, because
+	// they joined again elsewhere.
+	eventMemberDropped = "member_dropped"
+	// An instance asks the others for their members, having just started
+	// or lost track of them.
+	eventRosterRequest = "roster_request"
+	// An instance's members of one room, in reply. One without a room
+	// lists its connected users instead.
+	eventRoster = "roster"
+	// A room's settings changed and should be reloaded from the store.
+	eventRoomChanged = "room_changed"
+	eventHeartbeat   = "heartbeat"
+	// An instance has no members, because it just started or is shutting
+	// down.
+	eventNodeReset = "node_reset"
+	// UserID connected to an instance, or a connection of theirs closed.
+	// Other instances apply the session policy to theirs.
+	eventSessionStarted = "session_started"
+	eventSessionEnded   = "session_ended"
+)
+
+// missedHeartbeats is how many heartbeats an instance may miss before it
+// is presumed dead.
+const missedHeartbeats = 3
+
+// clusterEvent is what instances publish on the bus.
+type clusterEvent struct {
+	Kind    string              `json:"kind"`
+	Node    string              `json:"node"`
+	RoomID  string              `json:"roomId,omitempty"`
+	UserID  string              `json:"userId,omitempty"` // Deliver to this user only, or the member dropped
+	Message *models.Message     `json:"message,omitempty"`
+	Members []models.MemberInfo `json:"members,omitempty"`
+	Muted   []string            `json:"muted,omitempty"`
+
+	Sessions []string `json:"sessions,omitempty"` // One user ID per connection
+	Since    int64    `json:"since,omitempty"`    // When the session started, in Unix nanoseconds
+}
+
+// remoteRoster tracks the members connected to other instances, room by
+// room, as learned from the bus. Its lock may be taken while holding any
+// other, but nothing else is locked while holding it.
+type remoteRoster struct {
+	mu       sync.Mutex
+	rooms    map[string]*remoteRoom
+	sessions map[remoteKey]int    // Connections each user has on each instance
+	nodes    map[string]time.Time // When each instance was last heard from
+}
+
+// remoteRoom is one room's remote members, and its mutes so an instance
+// bringing the room live can pick them up.
+type remoteRoom struct {
+	members map[remoteKey]*remoteMember
+	muted   map[string]bool
+}
+
+type remoteKey struct{ node, userID string }
+
+type remoteMember struct {
+	info  models.MemberInfo
+	conns int // Connections the user has in the room on that instance
+}
+
+func newRemoteRoster() *remoteRoster {
+	return &remoteRoster{
+		rooms:    make(map[string]*remoteRoom),
+		sessions: make(map[remoteKey]int),
+		nodes:    make(map[string]time.Time),
+	}
+}
+
+// members returns roomID's remote members, once per instance they are on.
+func (r *remoteRoster) members(roomID string) []models.MemberInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var members []models.MemberInfo
+	if room := r.rooms[roomID]; room != nil {
+		for _, member := range room.members {
+			members = append(members, member.info)
+		}
+	}
+	return members
+}
+
+// count returns how many connections other instances have in roomID.
+func (r *remoteRoster) count(roomID string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := 0
+	if room := r.rooms[roomID]; room != nil {
+		for _, member := range room.members {
+			n += member.conns
+		}
+	}
+	return n
+}
+
+// has reports whether userID is in roomID on another instance.
+func (r *remoteRoster) has(roomID, userID string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if room := r.rooms[roomID]; room != nil {
+		for key := range room.members {
+			if key.userID == userID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// muted returns who is muted in roomID according to other instances.
+func (r *remoteRoster) muted(roomID string) map[string]bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	muted := make(map[string]bool)
+	if room := r.rooms[roomID]; room != nil {
+		for userID := range room.muted {
+			muted[userID] = true
+		}
+	}
+	return muted
+}
+
+// setMuted records a mute made on this instance, for the others' members
+// to carry on with if this instance's members leave.
+func (r *remoteRoster) setMuted(roomID, userID string, muted bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if room := r.rooms[roomID]; room != nil {
+		room.setMuted(userID, muted)
+	}
+}
+
+func (room *remoteRoom) setMuted(userID string, muted bool) {
+	if muted {
+		room.muted[userID] = true
+	} else {
+		delete(room.muted, userID)
+	}
+}
+
+// apply updates the roster from a room message node delivered.
+func (r *remoteRoster) apply(node, roomID string, msg models.Message) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch payload := msg.Payload.(type) {
+	case models.UserJoinedPayload:
+		room := r.room(roomID)
+		key := remoteKey{node, payload.User.UserID}
+		if member := room.members[key]; member != nil {
+			member.info = payload.User
+			member.conns++
+		} else {
+			room.members[key] = &remoteMember{info: payload.User, conns: 1}
+		}
+	case models.MemberInfo:
+		if msg.Type == models.MessageUserLeft {
+			r.drop(node, roomID, payload.UserID)
+		}
+	case models.MemberKickedPayload:
+		r.removeUser(roomID, payload.UserID)
+	case models.PresenceChangedPayload:
+		if room := r.rooms[roomID]; room != nil {
+			if member := room.members[remoteKey{node, payload.UserID}]; member != nil {
+				member.info.Presence = payload.Presence
+			}
+		}
+	case models.MemberMutedPayload:
+		if room := r.rooms[roomID]; room != nil {
+			room.setMuted(payload.UserID, payload.Muted)
+		}
+	}
+}
+
+// drop forgets one of userID's connections to roomID on node. Callers
+// must hold r.mu.
+func (r *remoteRoster) drop(node, roomID, userID string) {
+	room := r.rooms[roomID]
+	if room == nil {
+		return
+	}
+	key := remoteKey{node, userID}
+	if member := room.members[key]; member != nil {
+		if member.conns--; member.conns <= 0 {
+			delete(room.members, key)
+		}
+	}
+	r.closeIfEmpty(roomID)
+}
+
+// removeUser forgets userID's connections to roomID on every instance.
+// Callers must hold r.mu.
+func (r *remoteRoster) removeUser(roomID, userID string) {
+	room := r.rooms[roomID]
+	if room == nil {
+		return
+	}
+	for key := range room.members {
+		if key.userID == userID {
+			delete(room.members, key)
+		}
+	}
+	r.closeIfEmpty(roomID)
+}
+
+// kicked forgets userID's connections to roomID on every instance, after
+// this one kicked them.
+func (r *remoteRoster) kicked(roomID, userID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.removeUser(roomID, userID)
+}
+
+// dropMember forgets one of userID's connections to roomID on node.
+func (r *remoteRoster) dropMember(node, roomID, userID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.drop(node, roomID, userID)
+}
+
+// replace sets node's members of roomID, adds its mutes, and returns the
+// members that were not known before.
+func (r *remoteRoster) replace(node, roomID string, members []models.MemberInfo, muted []string) []models.MemberInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	room := r.room(roomID)
+	known := make(map[string]bool)
+	for key := range room.members {
+		if key.node == node {
+			known[key.userID] = true
+			delete(room.members, key)
+		}
+	}
+
+	var added []models.MemberInfo
+	for _, info := range members {
+		key := remoteKey{node, info.UserID}
+		if member := room.members[key]; member != nil {
+			member.conns++
+			continue
+		}
+		room.members[key] = &remoteMember{info: info, conns: 1}
+		if !known[info.UserID] {
+			added = append(added, info)
+		}
+	}
+	for _, userID := range muted {
+		room.muted[userID] = true
+	}
+	r.closeIfEmpty(roomID)
+	return added
+}
+
+// hasSession reports whether userID is connected to another instance.
+func (r *remoteRoster) hasSession(userID string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key := range r.sessions {
+		if key.userID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// addSession counts a connection of userID's to node, or one fewer when
+// delta is negative.
+func (r *remoteRoster) addSession(node, userID string, delta int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := remoteKey{node, userID}
+	if r.sessions[key] += delta; r.sessions[key] <= 0 {
+		delete(r.sessions, key)
+	}
+}
+
+// replaceSessions sets node's connected users, one entry per connection.
+func (r *remoteRoster) replaceSessions(node string, userIDs []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key := range r.sessions {
+		if key.node == node {
+			delete(r.sessions, key)
+		}
+	}
+	for _, userID := range userIDs {
+		r.sessions[remoteKey{node, userID}]++
+	}
+}
+
+// forgetNode drops everything about node and returns the members it had,
+// by room.
+func (r *remoteRoster) forgetNode(node string) map[string][]models.MemberInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.nodes, node)
+	for key := range r.sessions {
+		if key.node == node {
+			delete(r.sessions, key)
+		}
+	}
+	gone := make(map[string][]models.MemberInfo)
+	for roomID, room := range r.rooms {
+		for key, member := range room.members {
+			if key.node == node {
+				gone[roomID] = append(gone[roomID], member.info)
+				delete(room.members, key)
+			}
+		}
+		r.closeIfEmpty(roomID)
+	}
+	return gone
+}
+
+// heard records that node is alive and reports whether it was already
+// known.
+func (r *remoteRoster) heard(node string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, known := r.nodes[node]
+	r.nodes[node] = time.Now()
+	return known
+}
+
+// silent returns the instances not heard from for longer than timeout.
+func (r *remoteRoster) silent(timeout time.Duration) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var nodes []string
+	for node, last := range r.nodes {
+		if time.Since(last) > timeout {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// room returns roomID's remote state, creating it if needed. Callers must
+// hold r.mu and call closeIfEmpty afterwards.
+func (r *remoteRoster) room(roomID string) *remoteRoom {
+	room := r.rooms[roomID]
+	if room == nil {
+		room = &remoteRoom{
+			members: make(map[remoteKey]*remoteMember),
+			muted:   make(map[string]bool),
+		}
+		r.rooms[roomID] = room
+	}
+	return room
+}
+
+// closeIfEmpty forgets roomID once no other instance has members in it.
+// Callers must hold r.mu.
+func (r *remoteRoster) closeIfEmpty(roomID string) {
+	if room := r.rooms[roomID]; room != nil && len(room.members) == 0 {
+		delete(r.rooms, roomID)
+	}
+}
+
+// startCluster subscribes to the bus, asks the other instances who they
+// have, and starts heartbeating.
+func (wss *WebSocketServer) startCluster() {
+	wss.bus.Subscribe(wss.handleClusterEvent)
+	// Forget any members from before a crash, if NodeID was reused
+	wss.publish(clusterEvent{Kind: eventNodeReset})
+	wss.publish(clusterEvent{Kind: eventRosterRequest})
+
+	go func() {
+		ticker := time.NewTicker(wss.config.ClusterHeartbeatInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				wss.publish(clusterEvent{Kind: eventHeartbeat})
+				for _, node := range wss.remote.silent(missedHeartbeats * wss.config.ClusterHeartbeatInterval) {
+					log.Printf("instance %s stopped sending heartbeats, dropping its members", node)
+					wss.forgetNode(node)
+				}
+			case <-wss.clusterDone:
+				return
+			}
+		}
+	}()
+}
+
+// stopCluster tells the other instances this one's members are gone and
+// stops publishing.
+func (wss *WebSocketServer) stopCluster() {
+	wss.publish(clusterEvent{Kind: eventNodeReset})
+	if wss.clusterStopped.CompareAndSwap(false, true) {
+		close(wss.clusterDone)
+	}
+}
+
+// publish sends event to the other instances.
+func (wss *WebSocketServer) publish(event clusterEvent) {
+	if wss.clusterStopped.Load() {
+		return
+	}
+	event.Node = wss.config.NodeID
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("error encoding %s cluster event: %v", event.Kind, err)
+		return
+	}
+	if err := wss.bus.Publish(payload); err != nil {
+		log.Printf("error publishing %s cluster event: %v", event.Kind, err)
+	}
+}
+
+// publishRoomChanged tells the other instances to reload roomID's
+// settings.
+func (wss *WebSocketServer) publishRoomChanged(roomID string) {
+	wss.publish(clusterEvent{Kind: eventRoomChanged, RoomID: roomID})
+}
+
+// handleClusterEvent applies an event another instance published.
+func (wss *WebSocketServer) handleClusterEvent(payload []byte) {
+	var event clusterEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		log.Printf("error decoding cluster event: %v", err)
+		return
+	}
+	if event.Node == wss.config.NodeID {
+		return
+	}
+
+	switch event.Kind {
+	case eventNodeReset:
+		wss.forgetNode(event.Node)
+		return
+	case eventRosterRequest:
+		wss.publishRosters()
+	case eventRoster:
+		if event.RoomID != "" {
+			wss.applyRoster(event)
+		} else {
+			wss.remote.replaceSessions(event.Node, event.Sessions)
+		}
+	case eventSessionStarted:
+		wss.remote.addSession(event.Node, event.UserID, 1)
+		wss.takeOverRemote(event.UserID, event.Since)
+	case eventSessionEnded:
+		wss.remote.addSession(event.Node, event.UserID, -1)
+	case eventDeliver:
+		wss.deliverRemote(event)
+	case eventMemberDropped:
+		wss.remote.dropMember(event.Node, event.RoomID, event.UserID)
+	case eventRoomChanged:
+		wss.refreshRoom(event.RoomID)
+	}
+
+	// An instance heard from for the first time, or again after going
+	// silent, may have members this one missed
+	if !wss.remote.heard(event.Node) && event.Kind != eventRoster && event.Kind != eventRosterRequest {
+		wss.publish(clusterEvent{Kind: eventRosterRequest})
+	}
+}
+
+// applyRoster records another instance's members of a room, telling the
+// members here about any they had not heard of.
+func (wss *WebSocketServer) applyRoster(event clusterEvent) {
+	added := wss.remote.replace(event.Node, event.RoomID, event.Members, event.Muted)
+	if len(added) == 0 {
+		return
+	}
+
+	room := wss.lockRoom(event.RoomID)
+	if room == nil {
+		return
+	}
+	defer room.mu.Unlock()
+	for _, member := range added {
+		wss.deliverLocal(room, "", models.Message{
+			Type:   models.MessageUserJoined,
+			RoomID: room.ID,
+			UserID: member.UserID,
+			Payload: models.UserJoinedPayload{
+				User: member,
+				Name: room.Name,
+			},
+		})
+	}
+}
+
+// deliverRemote hands a message from another instance to the members here
+// and applies whatever it changed about the room.
+func (wss *WebSocketServer) deliverRemote(event clusterEvent) {
+	if event.Message == nil {
+		return
+	}
+	msg := *event.Message
+	if err := decodeServerPayload(&msg); err != nil {
+		log.Printf("error decoding %s message from %s: %v", msg.Type, event.Node, err)
+		return
+	}
+
+	// The roster changes before the room is locked, so a member joining
+	// here meanwhile either lists the change or is told about it
+	wss.remote.apply(event.Node, event.RoomID, msg)
+
+	room := wss.lockRoom(event.RoomID)
+	if room == nil {
+		return
+	}
+	defer room.mu.Unlock()
+
+	switch payload := msg.Payload.(type) {
+	case models.UserJoinedPayload:
+		wss.dropDetachedMember(room, payload.User.UserID)
+	case models.MemberUnbannedPayload:
+		delete(room.Bans, payload.UserID)
+	case models.RoleChangedPayload:
+		if payload.Role == models.RoleModerator {
+			room.Moderators[payload.UserID] = true
+		} else {
+			delete(room.Moderators, payload.UserID)
+		}
+	case models.MemberMutedPayload:
+		if payload.Muted {
+			room.Muted[payload.UserID] = true
+		} else {
+			delete(room.Muted, payload.UserID)
+		}
+	}
+
+	wss.deliverLocal(room, event.UserID, msg)
+
+	// A kicked member hears it before being removed, as they would locally
+	if kicked, ok := msg.Payload.(models.MemberKickedPayload); ok {
+		if kicked.Banned {
+			room.Bans[kicked.UserID] = true
+		}
+		for _, conn := range wss.memberConns(room, kicked.UserID) {
+			if member, exists := wss.clientFor(conn); exists {
+				wss.removeFromRoom(room, member, false)
+			}
+		}
+		wss.closeIfEmpty(room)
+	}
+}
+
+// publishRosters tells the other instances who is connected here and who
+// is in each room.
+func (wss *WebSocketServer) publishRosters() {
+	sessions := clusterEvent{Kind: eventRoster}
+	wss.mu.RLock()
+	roomIDs := make([]string, 0, len(wss.rooms))
+	for roomID := range wss.rooms {
+		roomIDs = append(roomIDs, roomID)
+	}
+	for _, client := range wss.clients {
+		if !wss.isDetached(client) {
+			sessions.Sessions = append(sessions.Sessions, client.UserID)
+		}
+	}
+	wss.mu.RUnlock()
+	wss.publish(sessions)
+
+	for _, roomID := range roomIDs {
+		room := wss.lockRoom(roomID)
+		if room == nil {
+			continue
+		}
+
+		event := clusterEvent{Kind: eventRoster, RoomID: roomID}
+		wss.mu.RLock()
+		for conn := range room.Members {
+			if member, exists := wss.clients[conn]; exists {
+				event.Members = append(event.Members, memberInfo(room.Room, member))
+			}
+		}
+		wss.mu.RUnlock()
+		for userID := range room.Muted {
+			event.Muted = append(event.Muted, userID)
+		}
+		room.mu.Unlock()
+
+		wss.publish(event)
+	}
+}
+
+// forgetNode drops an instance's members, telling the members here they
+// left.
+func (wss *WebSocketServer) forgetNode(node string) {
+	for roomID, members := range wss.remote.forgetNode(node) {
+		room := wss.lockRoom(roomID)
+		if room == nil {
+			continue
+		}
+		for _, member := range members {
+			wss.deliverLocal(room, "", models.Message{
+				Type:    models.MessageUserLeft,
+				RoomID:  roomID,
+				UserID:  member.UserID,
+				Payload: member,
+			})
+		}
+		room.mu.Unlock()
+	}
+}
+
+// deliverLocal sends msg to the members of room on this instance, or only
+// toUserID's connections if set. Callers must hold room.mu.
+func (wss *WebSocketServer) deliverLocal(room *liveRoom, toUserID string, msg models.Message) {
+	if toUserID != "" {
+		for _, conn := range wss.memberConns(room, toUserID) {
+			wss.sendTo(conn, msg)
+		}
+		return
+	}
+	for conn := range room.Members {
+		wss.sendTo(conn, msg)
+	}
+}
+
+// refreshRoom reloads a live room's settings after another instance
+// changed them.
+func (wss *WebSocketServer) refreshRoom(roomID string) {
+	wss.mu.RLock()
+	_, live := wss.rooms[roomID]
+	wss.mu.RUnlock()
+	if !live {
+		return
+	}
+
+	stored, err := wss.store.GetRoom(roomID)
+	if err != nil {
+		log.Printf("error reloading room %s: %v", roomID, err)
+		return
+	}
+	wss.applyRoomSettings(stored)
+}
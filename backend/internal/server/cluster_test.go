@@ -0,0 +1,86 @@
+package server
+
+import (
+	"encoding/json"
+	"portal/internal/bus"
+	"portal/internal/models"
+	"testing"
+)
+
+// Two instances sharing a store and a bus must behave as one: members on
+// either see each other join and leave, and signal across.
+func TestClusterAcrossNodes(t *testing.T) {
+	store := newMemStore()
+	events := bus.NewLocal()
+	t.Cleanup(func() { events.Close() })
+	nodeA := newTestNode(t, store, events, "node-a")
+	nodeB := newTestNode(t, store, events, "node-b")
+
+	room := &models.Room{ID: "room0001", Name: "Shared", IsPublic: true, Creator: "bob",
+		Moderators: map[string]bool{}, Bans: map[string]bool{}}
+	if err := store.CreateRoom(room); err != nil {
+		t.Fatal(err)
+	}
+
+	bob := nodeB.dial(t, "bob")
+	if msg := bob.join("room0001", models.JoinRoomPayload{}); msg.Type != models.MessageRoomJoined {
+		t.Fatalf("bob join: %s %s", msg.Type, msg.errorCode())
+	}
+
+	alice := nodeA.dial(t, "alice")
+	if msg := alice.join("room0001", models.JoinRoomPayload{}); msg.Type != models.MessageRoomJoined {
+		t.Fatalf("alice join: %s %s", msg.Type, msg.errorCode())
+	}
+
+	var joined models.UserJoinedPayload
+	if err := json.Unmarshal(bob.expect(models.MessageUserJoined).Payload, &joined); err != nil {
+		t.Fatal(err)
+	}
+	if joined.User.UserID != "alice" {
+		t.Errorf("bob saw %q join, want alice", joined.User.UserID)
+	}
+
+	tests := []struct {
+		name    string
+		from    *testClient
+		to      *testClient
+		msgType string
+		payload models.SignalingPayload
+		sdp     string
+	}{
+		{name: "offer from A to B", from: alice, to: bob, msgType: models.SignalOffer,
+			payload: models.SignalingPayload{SDP: "v=0 offer", ToUserID: "bob"}, sdp: "v=0 offer"},
+		{name: "answer from B to A", from: bob, to: alice, msgType: models.SignalAnswer,
+			payload: models.SignalingPayload{SDP: "v=0 answer", ToUserID: "alice"}, sdp: "v=0 answer"},
+		{name: "candidate from A to B", from: alice, to: bob, msgType: models.SignalCandidate,
+			payload: models.SignalingPayload{Candidate: &models.ICECandidate{Candidate: "candidate:1"}, ToUserID: "bob"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.from.send(models.Message{Type: tt.msgType, RoomID: "room0001", Payload: tt.payload})
+			tt.from.expect(models.MessageAck)
+
+			msg := tt.to.expect(tt.msgType)
+			var got models.SignalingPayload
+			if err := json.Unmarshal(msg.Payload, &got); err != nil {
+				t.Fatal(err)
+			}
+			if msg.RoomID != "room0001" || got.FromUserID != tt.from.userID {
+				t.Errorf("got %s in %s from %q, want from %s", msg.Type, msg.RoomID, got.FromUserID, tt.from.userID)
+			}
+			if got.SDP != tt.sdp {
+				t.Errorf("sdp = %q, want %q", got.SDP, tt.sdp)
+			}
+		})
+	}
+
+	alice.send(models.Message{Type: models.MessageLeaveRoom, RoomID: "room0001"})
+	var left models.MemberInfo
+	if err := json.Unmarshal(bob.expect(models.MessageUserLeft).Payload, &left); err != nil {
+		t.Fatal(err)
+	}
+	if left.UserID != "alice" {
+		t.Errorf("bob saw %q leave, want alice", left.UserID)
+	}
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"fmt"
+	"portal/internal/auth"
+	"portal/internal/models"
+	"portal/internal/utils"
+	"sort"
+)
+
+// featureCandidateBatches lets a slow client be sent signal_candidates
+// batches instead of losing candidates when its queue fills up.
+const featureCandidateBatches = "candidate_batches"
+
+// serverFeatures are advertised in the welcome message. A client lists the
+// ones it understands as capabilities, so new behaviour can be limited to
+// clients that asked for it.
+var serverFeatures = []string{
+	"acks",
+	"error_codes",
+	"typed_signals",
+	"moderation",
+	"invites",
+	"ice_servers",
+	"resume",
+	"presence",
+	featureCandidateBatches,
+}
+
+// handleHello negotiates the protocol version and capabilities. It returns
+// false after closing the connection if the client is incompatible.
+func (wss *WebSocketServer) handleHello(client *models.Client, msg models.Message, hello *models.HelloPayload) bool {
+	if hello.MinVersion == 0 {
+		hello.MinVersion = hello.Version
+	}
+
+	version := min(hello.Version, models.ProtocolVersion)
+	if version < max(hello.MinVersion, models.MinProtocolVersion) {
+		sendErrorPayload(client, msg, models.ErrorPayload{
+			Code:    models.ErrCodeUnsupportedVersion,
+			Message: fmt.Sprintf("Server supports protocol versions %d to %d", models.MinProtocolVersion, models.ProtocolVersion),
+			Details: map[string]interface{}{
+				"minVersion": models.MinProtocolVersion,
+				"maxVersion": models.ProtocolVersion,
+			},
+		})
+		client.Outbox.Close(models.CloseUnsupportedVersion, "unsupported protocol version")
+		return false
+	}
+
+	accepted := make([]string, 0)
+	for _, capability := range hello.Capabilities {
+		for _, feature := range serverFeatures {
+			if capability == feature && !client.Capabilities[feature] {
+				client.Capabilities[feature] = true
+				accepted = append(accepted, feature)
+			}
+		}
+	}
+	sort.Strings(accepted)
+	client.ProtocolVersion = version
+	if ob, ok := client.Outbox.(*outbox); ok {
+		ob.batches.Store(client.Capabilities[featureCandidateBatches])
+	}
+
+	reply(client, msg, models.Message{
+		Type: models.MessageWelcome,
+		Payload: models.WelcomePayload{
+			Version:      version,
+			MinVersion:   models.MinProtocolVersion,
+			MaxVersion:   models.ProtocolVersion,
+			Features:     serverFeatures,
+			Capabilities: accepted,
+			Limits: models.ProtocolLimits{
+				MaxMessageSize:     maxMessageSize,
+				MaxSDPLength:       maxSDPLength,
+				MaxCandidateLength: maxCandidateLength,
+				MaxUsernameLength:  utils.MaxUsernameLength,
+				MaxPasswordLength:  auth.MaxPasswordLength,
+			},
+		},
+	})
+	return true
+}
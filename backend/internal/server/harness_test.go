@@ -0,0 +1,376 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"portal/internal/auth"
+	"portal/internal/bus"
+	"portal/internal/config"
+	"portal/internal/db"
+	"portal/internal/models"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// memStore keeps rooms, users and invites in memory, standing in for
+// Postgres. Like Postgres, it hands out a fresh copy of a room on every
+// GetRoom.
+type memStore struct {
+	mu      sync.Mutex
+	rooms   map[string]*models.Room
+	invites map[string]*models.Invite
+
+	// onRedeem runs in RedeemInvite, to change things while a join is
+	// under way
+	onRedeem func()
+}
+
+func newMemStore() *memStore {
+	return &memStore{
+		rooms:   make(map[string]*models.Room),
+		invites: make(map[string]*models.Invite),
+	}
+}
+
+func (s *memStore) CreateRoom(room *models.Room) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.rooms[room.ID]; exists {
+		return db.ErrRoomExists
+	}
+	room.CreatedAt = time.Now()
+	room.UpdatedAt = room.CreatedAt
+	s.rooms[room.ID] = copyRoom(room)
+	return nil
+}
+
+func (s *memStore) GetRoom(id string) (*models.Room, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	room, exists := s.rooms[id]
+	if !exists {
+		return nil, db.ErrRoomNotFound
+	}
+	return copyRoom(room), nil
+}
+
+func (s *memStore) ListPublicRooms() ([]*models.Room, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var rooms []*models.Room
+	for _, room := range s.rooms {
+		if room.IsPublic {
+			rooms = append(rooms, copyRoom(room))
+		}
+	}
+	return rooms, nil
+}
+
+func (s *memStore) UpdateRoom(room *models.Room) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, exists := s.rooms[room.ID]
+	if !exists {
+		return db.ErrRoomNotFound
+	}
+	stored.Name, stored.IsPublic, stored.PasswordHash = room.Name, room.IsPublic, room.PasswordHash
+	stored.UpdatedAt = time.Now()
+	room.UpdatedAt = stored.UpdatedAt
+	return nil
+}
+
+func (s *memStore) ReplacePasswordHash(roomID, oldHash, newHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, exists := s.rooms[roomID]
+	if !exists || stored.PasswordHash != oldHash {
+		return db.ErrRoomNotFound
+	}
+	stored.PasswordHash = newHash
+	return nil
+}
+
+func (s *memStore) SetRole(roomID, userID, role string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stored, exists := s.rooms[roomID]; exists {
+		stored.Moderators[userID] = role == models.RoleModerator
+	}
+	return nil
+}
+
+func (s *memStore) AddBan(roomID, userID, bannedBy string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stored, exists := s.rooms[roomID]; exists {
+		stored.Bans[userID] = true
+	}
+	return nil
+}
+
+func (s *memStore) RemoveBan(roomID, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stored, exists := s.rooms[roomID]; exists {
+		delete(stored.Bans, userID)
+	}
+	return nil
+}
+
+func (s *memStore) CreateUser() (string, error)                         { return "", nil }
+func (s *memStore) GetUser(id string) (*models.User, error)             { return nil, db.ErrUserNotFound }
+func (s *memStore) UpdateUser(user *models.User) error                  { return nil }
+func (s *memStore) TouchUser(id string) error                           { return nil }
+func (s *memStore) CreateInvite(invite *models.Invite) error            { return s.addInvite(invite) }
+func (s *memStore) ListInvites(roomID string) ([]*models.Invite, error) { return nil, nil }
+func (s *memStore) RevokeInvite(roomID, id string) error                { return nil }
+
+func (s *memStore) addInvite(invite *models.Invite) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if invite.ID == "" {
+		invite.ID = generateRoomID()
+	}
+	invite.CreatedAt = time.Now()
+	stored := *invite
+	s.invites[invite.ID] = &stored
+	return nil
+}
+
+func (s *memStore) RedeemInvite(roomID, id, userID string) error {
+	if s.onRedeem != nil {
+		s.onRedeem()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	invite, exists := s.invites[id]
+	if !exists || invite.RoomID != roomID || invite.RevokedAt != nil || time.Now().After(invite.ExpiresAt) ||
+		invite.Uses >= invite.MaxUses || (invite.RecipientID != "" && invite.RecipientID != userID) {
+		return db.ErrInviteUnusable
+	}
+	invite.Uses++
+	return nil
+}
+
+func (s *memStore) ReleaseInvite(roomID, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if invite, exists := s.invites[id]; exists && invite.RoomID == roomID && invite.Uses > 0 {
+		invite.Uses--
+	}
+	return nil
+}
+
+// inviteUses returns how many joins invite id has been used for.
+func (s *memStore) inviteUses(id string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.invites[id].Uses
+}
+
+func copyRoom(room *models.Room) *models.Room {
+	c := *room
+	c.Members = make(map[*websocket.Conn]string)
+	c.Moderators = copySet(room.Moderators)
+	c.Bans = copySet(room.Bans)
+	c.Muted = make(map[string]bool)
+	return &c
+}
+
+func copySet(set map[string]bool) map[string]bool {
+	c := make(map[string]bool, len(set))
+	for key, value := range set {
+		c[key] = value
+	}
+	return c
+}
+
+const testSessionKeys = "test:0123456789abcdef0123456789abcdef"
+
+func testConfig(nodeID string) *config.Config {
+	return &config.Config{
+		PasswordCost:             bcrypt.MinCost,
+		JoinLockoutIPThreshold:   5,
+		JoinLockoutRoomThreshold: 20,
+		JoinLockoutBaseDelay:     time.Second,
+		JoinLockoutMaxDelay:      time.Minute,
+		HeartbeatInterval:        time.Minute,
+		HeartbeatTimeout:         2 * time.Minute,
+		SendQueueSize:            64,
+		SlowClientPolicy:         config.SlowClientDrop,
+		ShutdownReconnectAfter:   time.Second,
+		ClusterBus:               config.ClusterBusLocal,
+		NodeID:                   nodeID,
+		ClusterHeartbeatInterval: time.Minute,
+		SessionPolicy:            config.SessionMultiple,
+	}
+}
+
+// testNode is a WebSocketServer behind a loopback HTTP server, which takes
+// the user ID from the query instead of a session token.
+type testNode struct {
+	wss  *WebSocketServer
+	keys *auth.Keyring
+	url  string
+}
+
+func newTestNode(t *testing.T, store *memStore, events bus.Bus, nodeID string) *testNode {
+	t.Helper()
+	keys, err := auth.NewKeyring(testSessionKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wss := NewWebSocketServer(testConfig(nodeID), keys, store, store, store, events)
+
+	var upgrader websocket.Upgrader
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		wss.HandleConnection(conn, r.URL.Query().Get("user"), "127.0.0.1")
+	}))
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		wss.Shutdown(ctx)
+		srv.Close()
+	})
+
+	return &testNode{
+		wss:  wss,
+		keys: keys,
+		url:  "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws",
+	}
+}
+
+// received is a message as a client sees it, with the payload left raw.
+type received struct {
+	ID      string          `json:"id"`
+	Type    string          `json:"type"`
+	RoomID  string          `json:"roomId"`
+	UserID  string          `json:"userId"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+type testClient struct {
+	t        *testing.T
+	userID   string
+	conn     *websocket.Conn
+	requests int // IDs handed out by request
+}
+
+func (n *testNode) dial(t *testing.T, userID string) *testClient {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(n.url+"?user="+userID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testClient{t: t, userID: userID, conn: conn}
+}
+
+func (c *testClient) send(msg models.Message) {
+	c.t.Helper()
+	if err := c.conn.WriteJSON(msg); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// expect reads messages until one of msgType arrives, skipping others.
+func (c *testClient) expect(msgType string) received {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var msg received
+		if err := c.conn.ReadJSON(&msg); err != nil {
+			c.t.Fatalf("%s waiting for %s: %v", c.userID, msgType, err)
+		}
+		if msg.Type == msgType {
+			return msg
+		}
+	}
+}
+
+// join joins roomID and returns room_joined, or whatever error came instead.
+func (c *testClient) join(roomID string, payload models.JoinRoomPayload) received {
+	c.t.Helper()
+	if payload.Username == "" {
+		payload.Username = c.userID
+	}
+	if payload.AvatarID == "" {
+		payload.AvatarID = "kazuha"
+	}
+	c.send(models.Message{Type: models.MessageJoinRoom, RoomID: roomID, Payload: payload})
+
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var msg received
+		if err := c.conn.ReadJSON(&msg); err != nil {
+			c.t.Fatalf("%s joining %s: %v", c.userID, roomID, err)
+		}
+		if msg.Type == models.MessageRoomJoined || msg.Type == models.MessageError {
+			return msg
+		}
+	}
+}
+
+// errorCode returns the code of an error message.
+func (m received) errorCode() string {
+	var payload models.ErrorPayload
+	json.Unmarshal(m.Payload, &payload)
+	return payload.Code
+}
+
+// request sends msg with a fresh ID and reads until the ack or error
+// answering it arrives. It returns the error code, or "" for an ack.
+func (c *testClient) request(msg models.Message) string {
+	c.t.Helper()
+	c.requests++
+	msg.ID = fmt.Sprintf("%s-%d", c.userID, c.requests)
+	c.send(msg)
+
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var reply received
+		if err := c.conn.ReadJSON(&reply); err != nil {
+			c.t.Fatalf("%s waiting for a reply to %s: %v", c.userID, msg.Type, err)
+		}
+		if reply.ID != msg.ID {
+			continue
+		}
+		switch reply.Type {
+		case models.MessageAck:
+			return ""
+		case models.MessageError:
+			return reply.errorCode()
+		}
+	}
+}
+
+// expectClose reads until the server closes the connection and returns the
+// close code and reason.
+func (c *testClient) expectClose() (int, string) {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, _, err := c.conn.ReadMessage()
+		var closeErr *websocket.CloseError
+		if errors.As(err, &closeErr) {
+			return closeErr.Code, closeErr.Text
+		}
+		if err != nil {
+			c.t.Fatalf("%s waiting for the close frame: %v", c.userID, err)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"net/http"
+	"portal/internal/auth"
+	"portal/internal/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (s *Server) GetICEServers(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"iceServers": s.config.ICEServers,
+	})
+}
+
+// CreateTURNCredentials mints short-lived TURN credentials for the current
+// user, so no static TURN password has to ship with the frontend.
+func (s *Server) CreateTURNCredentials(c *gin.Context) {
+	if s.config.TURNSecret == "" || len(s.config.TURNURLs) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "TURN is not configured",
+		})
+		return
+	}
+
+	username, password, expiresAt := auth.TURNCredentials(s.config.TURNSecret, currentUserID(c), s.config.TURNCredentialTTL)
+
+	c.JSON(http.StatusCreated, gin.H{
+		"username":  username,
+		"password":  password,
+		"ttl":       int(s.config.TURNCredentialTTL.Seconds()),
+		"expiresAt": expiresAt,
+		"uris":      s.config.TURNURLs,
+		"iceServer": models.ICEServer{
+			URLs:       s.config.TURNURLs,
+			Username:   username,
+			Credential: password,
+		},
+	})
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"portal/internal/auth"
+	"portal/internal/db"
+	"portal/internal/models"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultInviteTTL = time.Hour
+	maxInviteTTL     = 30 * 24 * time.Hour
+	maxInviteUses    = 1000
+)
+
+func (s *Server) CreateInvite(c *gin.Context) {
+	type createInviteRequest struct {
+		ExpiresIn   int    `json:"expiresIn,omitempty"` // Seconds, defaults to an hour
+		MaxUses     int    `json:"maxUses,omitempty"`   // Defaults to a single use
+		RecipientID string `json:"recipientId,omitempty"`
+	}
+
+	var req createInviteRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+		})
+		return
+	}
+
+	ttl := defaultInviteTTL
+	if req.ExpiresIn != 0 {
+		ttl = time.Duration(req.ExpiresIn) * time.Second
+	}
+	if ttl < time.Minute || ttl > maxInviteTTL {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "expiresIn must be between 60 seconds and 30 days",
+		})
+		return
+	}
+
+	maxUses := req.MaxUses
+	if maxUses == 0 {
+		maxUses = 1
+	}
+	if maxUses < 1 || maxUses > maxInviteUses {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "maxUses must be between 1 and 1000",
+		})
+		return
+	}
+
+	room, ok := s.loadCreatorRoom(c)
+	if !ok {
+		return
+	}
+
+	invite := &models.Invite{
+		RoomID:      room.ID,
+		CreatedBy:   currentUserID(c),
+		RecipientID: req.RecipientID,
+		MaxUses:     maxUses,
+		ExpiresAt:   time.Now().Add(ttl),
+	}
+	if err := s.invites.CreateInvite(invite); err != nil {
+		log.Printf("error creating invite for room %s: %v", room.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to create invite",
+		})
+		return
+	}
+
+	token, err := s.keys.Sign(auth.Claims{
+		Subject:   invite.ID,
+		Purpose:   auth.PurposeInvite,
+		IssuedAt:  invite.CreatedAt.Unix(),
+		ExpiresAt: invite.ExpiresAt.Unix(),
+		RoomID:    room.ID,
+	})
+	if err != nil {
+		log.Printf("error signing invite %s: %v", invite.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to create invite",
+		})
+		return
+	}
+
+	response := inviteResponse(invite)
+	response["token"] = token
+	c.JSON(http.StatusCreated, response)
+}
+
+func (s *Server) GetInvites(c *gin.Context) {
+	room, ok := s.loadCreatorRoom(c)
+	if !ok {
+		return
+	}
+
+	invites, err := s.invites.ListInvites(room.ID)
+	if err != nil {
+		log.Printf("error listing invites for room %s: %v", room.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to list invites",
+		})
+		return
+	}
+
+	response := make([]gin.H, 0, len(invites))
+	for _, invite := range invites {
+		response = append(response, inviteResponse(invite))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"invites": response,
+	})
+}
+
+func (s *Server) DeleteInvite(c *gin.Context) {
+	room, ok := s.loadCreatorRoom(c)
+	if !ok {
+		return
+	}
+
+	err := s.invites.RevokeInvite(room.ID, c.Param("inviteId"))
+	if errors.Is(err, db.ErrInviteNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Invite not found",
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("error revoking invite %s: %v", c.Param("inviteId"), err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to revoke invite",
+		})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// loadCreatorRoom loads the room named in the path and checks that the
+// current user created it, writing the error response itself otherwise.
+func (s *Server) loadCreatorRoom(c *gin.Context) (*models.Room, bool) {
+	roomID := c.Param("id")
+
+	room, err := s.rooms.GetRoom(roomID)
+	if errors.Is(err, db.ErrRoomNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Room not found",
+		})
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("error loading room %s: %v", roomID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to load room",
+		})
+		return nil, false
+	}
+
+	if room.Creator != currentUserID(c) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "Only the room creator can manage invites",
+		})
+		return nil, false
+	}
+	return room, true
+}
+
+func inviteResponse(invite *models.Invite) gin.H {
+	return gin.H{
+		"inviteId":    invite.ID,
+		"roomId":      invite.RoomID,
+		"recipientId": invite.RecipientID,
+		"maxUses":     invite.MaxUses,
+		"uses":        invite.Uses,
+		"expiresAt":   invite.ExpiresAt,
+		"revokedAt":   invite.RevokedAt,
+		"createdAt":   invite.CreatedAt,
+	}
+}
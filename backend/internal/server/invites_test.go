@@ -0,0 +1,85 @@
+package server
+
+import (
+	"portal/internal/auth"
+	"portal/internal/bus"
+	"portal/internal/models"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestInviteJoins(t *testing.T) {
+	hash, err := auth.HashPassword("secret", bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		// banDuringRedeem bans the joiner while the invite is redeemed,
+		// after the first ban check passed
+		banDuringRedeem bool
+		bannedBefore    bool
+		code            string
+		uses            int
+	}{
+		{name: "joins and uses the invite", uses: 1},
+		{name: "banned before redeeming never uses the invite", bannedBefore: true, code: models.ErrCodeBanned},
+		{name: "banned while redeeming gives the use back", banDuringRedeem: true, code: models.ErrCodeBanned},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newMemStore()
+			node := newTestNode(t, store, bus.NewLocal(), "node-a")
+
+			room := &models.Room{ID: "room0001", Name: "Private", Creator: "owner", PasswordHash: hash,
+				Moderators: map[string]bool{}, Bans: map[string]bool{"alice": tt.bannedBefore}}
+			if err := store.CreateRoom(room); err != nil {
+				t.Fatal(err)
+			}
+			invite := &models.Invite{RoomID: "room0001", CreatedBy: "owner", MaxUses: 1, ExpiresAt: time.Now().Add(time.Hour)}
+			store.CreateInvite(invite)
+			token, err := node.keys.Sign(auth.Claims{
+				Subject: invite.ID, Purpose: auth.PurposeInvite, RoomID: "room0001",
+				ExpiresAt: invite.ExpiresAt.Unix(),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The owner keeps the room live so the ban lands on it
+			owner := node.dial(t, "owner")
+			if msg := owner.join("room0001", models.JoinRoomPayload{Password: "secret"}); msg.Type != models.MessageRoomJoined {
+				t.Fatalf("owner join: %s %s", msg.Type, msg.errorCode())
+			}
+			if tt.banDuringRedeem {
+				store.onRedeem = func() {
+					live := node.wss.lockRoom("room0001")
+					live.Bans["alice"] = true
+					live.mu.Unlock()
+				}
+			}
+
+			alice := node.dial(t, "alice")
+			msg := alice.join("room0001", models.JoinRoomPayload{InviteToken: token})
+			if tt.code == "" && msg.Type != models.MessageRoomJoined {
+				t.Fatalf("join: %s %s", msg.Type, msg.errorCode())
+			}
+			if tt.code != "" && msg.errorCode() != tt.code {
+				t.Fatalf("join: %s %q, want error %q", msg.Type, msg.errorCode(), tt.code)
+			}
+
+			// Released in the background, once the room lock is let go
+			deadline := time.Now().Add(2 * time.Second)
+			for store.inviteUses(invite.ID) != tt.uses && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if uses := store.inviteUses(invite.ID); uses != tt.uses {
+				t.Errorf("invite used %d times, want %d", uses, tt.uses)
+			}
+		})
+	}
+}
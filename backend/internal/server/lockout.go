@@ -0,0 +1,224 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"portal/internal/auth"
+	"portal/internal/models"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// lockoutTracker counts failed attempts per key and locks a key out with
+// exponential backoff once it crosses its threshold. Attempts are counted
+// as failures before the password is checked and taken back if it was
+// right, so parallel attempts cannot all slip in under a threshold while
+// bcrypt runs.
+type lockoutTracker struct {
+	mu        sync.Mutex
+	records   map[string]*attemptRecord
+	baseDelay time.Duration
+	maxDelay  time.Duration
+	lastSweep time.Time
+}
+
+type attemptRecord struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+func newLockoutTracker(baseDelay, maxDelay time.Duration) *lockoutTracker {
+	return &lockoutTracker{
+		records:   make(map[string]*attemptRecord),
+		baseDelay: baseDelay,
+		maxDelay:  maxDelay,
+		lastSweep: time.Now(),
+	}
+}
+
+// lockoutLimit is a key an attempt counts against and the failures it
+// takes to lock that key out.
+type lockoutLimit struct {
+	key       string
+	threshold int
+}
+
+// attempt counts an attempt against every limit as a failure. If any key
+// is locked out, nothing is counted and the longest wait is returned.
+// Otherwise it returns each key's failure count, including this attempt,
+// and whether the attempt locked any key out. Failures are forgotten after
+// maxDelay without another one.
+func (t *lockoutTracker) attempt(limits ...lockoutLimit) (wait time.Duration, failures []int, locked bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	t.sweep(now)
+
+	for _, limit := range limits {
+		if record, exists := t.records[limit.key]; exists {
+			wait = max(wait, record.lockedUntil.Sub(now))
+		}
+	}
+	if wait > 0 {
+		return wait, nil, false
+	}
+
+	failures = make([]int, len(limits))
+	for i, limit := range limits {
+		record, exists := t.records[limit.key]
+		if !exists || now.Sub(record.lastFailure) > t.maxDelay {
+			record = &attemptRecord{}
+			t.records[limit.key] = record
+		}
+		record.failures++
+		record.lastFailure = now
+		failures[i] = record.failures
+
+		if record.failures < limit.threshold {
+			continue
+		}
+		delay := t.maxDelay
+		if shift := record.failures - limit.threshold; shift < 32 {
+			delay = min(t.baseDelay<<shift, t.maxDelay)
+		}
+		record.lockedUntil = now.Add(delay)
+		locked = true
+	}
+	return 0, failures, locked
+}
+
+// refund takes back an attempt that turned out to be right, lifting the
+// lockout it may have triggered if the key is back under its threshold.
+func (t *lockoutTracker) refund(limit lockoutLimit) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	record, exists := t.records[limit.key]
+	if !exists {
+		return
+	}
+	if record.failures--; record.failures < limit.threshold {
+		record.lockedUntil = time.Time{}
+	}
+	if record.failures <= 0 {
+		delete(t.records, limit.key)
+	}
+}
+
+// reset forgets every failure recorded for key.
+func (t *lockoutTracker) reset(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.records, key)
+}
+
+// sweep drops records that can no longer affect anything. Callers must
+// hold t.mu.
+func (t *lockoutTracker) sweep(now time.Time) {
+	if now.Sub(t.lastSweep) < t.maxDelay {
+		return
+	}
+	t.lastSweep = now
+
+	for key, record := range t.records {
+		if now.Sub(record.lastFailure) > t.maxDelay && now.After(record.lockedUntil) {
+			delete(t.records, key)
+		}
+	}
+}
+
+type joinCheck int
+
+const (
+	joinAllowed joinCheck = iota
+	joinBadPassword
+	joinLockedOut
+)
+
+// checkJoinPassword verifies userID's password for a private room,
+// enforcing the per-IP and per-room lockouts. The returned duration is how
+// long the caller must wait when locked out.
+//
+// The room lockout holds off guessing spread over many IPs, but anyone can
+// trigger it, so it does not apply to the room creator, and invites bypass
+// it. A right password clears the IP's failures but only takes back its own
+// attempt from the room's, which otherwise expire with time, so members
+// getting in do not reset the count for someone guessing alongside them.
+func (wss *WebSocketServer) checkJoinPassword(roomID, creator, passwordHash, userID, ip, password string) (joinCheck, time.Duration) {
+	ipLimit := lockoutLimit{"ip:" + ip, wss.config.JoinLockoutIPThreshold}
+	roomLimit := lockoutLimit{"room:" + roomID, wss.config.JoinLockoutRoomThreshold}
+	limits := []lockoutLimit{ipLimit}
+	if userID != creator {
+		limits = append(limits, roomLimit)
+	}
+
+	wait, failures, locked := wss.lockouts.attempt(limits...)
+	if wait > 0 {
+		return joinLockedOut, wait
+	}
+
+	ok, needsRehash := auth.VerifyPassword(passwordHash, password, wss.config.PasswordCost)
+	if !ok {
+		if locked {
+			roomFailures, roomLocked := 0, false
+			if len(failures) > 1 {
+				roomFailures = failures[1]
+				roomLocked = roomFailures >= roomLimit.threshold
+			}
+			wss.notifyFailedJoins(roomID, creator, roomFailures, roomLocked)
+		}
+		return joinBadPassword, 0
+	}
+
+	wss.lockouts.reset(ipLimit.key)
+	if len(limits) > 1 {
+		wss.lockouts.refund(roomLimit)
+	}
+	if needsRehash {
+		wss.rehashRoomPassword(roomID, passwordHash, password)
+	}
+	return joinAllowed, 0
+}
+
+// notifyFailedJoins tells the room creator, if connected, that a lockout
+// was triggered on their room.
+func (wss *WebSocketServer) notifyFailedJoins(roomID, creator string, failures int, roomLocked bool) {
+	wss.mu.RLock()
+	var conns []*websocket.Conn
+	for conn, client := range wss.clients {
+		if client.UserID == creator {
+			conns = append(conns, conn)
+		}
+	}
+	wss.mu.RUnlock()
+
+	for _, conn := range conns {
+		wss.sendTo(conn, models.Message{
+			Type:   models.MessageJoinAttemptsFailed,
+			RoomID: roomID,
+			Payload: models.JoinAttemptsFailedPayload{
+				Failures:   failures,
+				RoomLocked: roomLocked,
+			},
+		})
+	}
+}
+
+// lockoutSeconds rounds a lockout up to whole seconds.
+func lockoutSeconds(wait time.Duration) int {
+	return int(math.Ceil(wait.Seconds()))
+}
+
+// newLockoutError is the error sent when a join is locked out for
+// retryAfter seconds.
+func newLockoutError(retryAfter int) models.ErrorPayload {
+	return models.ErrorPayload{
+		Code:    models.ErrCodeJoinLockedOut,
+		Message: fmt.Sprintf("Too many failed attempts, retry after %d seconds", retryAfter),
+		Details: map[string]interface{}{"retryAfter": retryAfter},
+	}
+}
@@ -0,0 +1,246 @@
+package server
+
+import (
+	"portal/internal/auth"
+	"portal/internal/config"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// expire ends key's lockout as if its delay had passed.
+func (t *lockoutTracker) expire(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if record := t.records[key]; record != nil {
+		record.lockedUntil = time.Now().Add(-time.Millisecond)
+	}
+}
+
+// waitFor returns how long key is locked out for, without counting an
+// attempt.
+func (t *lockoutTracker) waitFor(key string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if record := t.records[key]; record != nil {
+		return max(time.Until(record.lockedUntil), 0)
+	}
+	return 0
+}
+
+func TestLockoutBackoff(t *testing.T) {
+	tracker := newLockoutTracker(time.Second, 8*time.Second)
+	limit := lockoutLimit{"ip:1.2.3.4", 3}
+
+	tests := []struct {
+		failures int
+		delay    time.Duration
+	}{
+		{failures: 1},
+		{failures: 2},
+		{failures: 3, delay: time.Second},
+		{failures: 4, delay: 2 * time.Second},
+		{failures: 5, delay: 4 * time.Second},
+		{failures: 6, delay: 8 * time.Second},
+		{failures: 7, delay: 8 * time.Second},
+		{failures: 40, delay: 8 * time.Second},
+	}
+
+	failures := 0
+	for _, tt := range tests {
+		for failures < tt.failures {
+			tracker.expire(limit.key)
+			wait, counts, locked := tracker.attempt(limit)
+			if wait > 0 {
+				t.Fatalf("attempt %d refused for %v", failures+1, wait)
+			}
+			failures = counts[0]
+			if failures == tt.failures && locked != (tt.delay > 0) {
+				t.Errorf("failure %d: locked = %v", failures, locked)
+			}
+		}
+		if failures != tt.failures {
+			t.Fatalf("failures = %d, want %d", failures, tt.failures)
+		}
+
+		wait := tracker.waitFor(limit.key)
+		if wait > tt.delay || wait < tt.delay-100*time.Millisecond {
+			t.Errorf("after %d failures: locked out for %v, want %v", tt.failures, wait, tt.delay)
+		}
+	}
+}
+
+func TestLockoutRefusesWhileLocked(t *testing.T) {
+	tracker := newLockoutTracker(time.Minute, time.Hour)
+	ip := lockoutLimit{"ip:1.2.3.4", 1}
+	room := lockoutLimit{"room:abc", 10}
+
+	if wait, _, locked := tracker.attempt(ip, room); wait > 0 || !locked {
+		t.Fatalf("first attempt: wait = %v, locked = %v", wait, locked)
+	}
+
+	wait, failures, _ := tracker.attempt(ip, room)
+	if wait <= 0 || failures != nil {
+		t.Fatalf("attempt while locked: wait = %v, failures = %v", wait, failures)
+	}
+
+	// A refused attempt counts against none of its keys
+	if _, failures, _ := tracker.attempt(room); failures[0] != 2 {
+		t.Errorf("room failures = %d, want 2", failures[0])
+	}
+}
+
+// Attempts in flight count before their passwords are checked, so a burst
+// of them cannot get more than the threshold through.
+func TestLockoutParallelAttempts(t *testing.T) {
+	tracker := newLockoutTracker(time.Minute, time.Hour)
+	limit := lockoutLimit{"room:abc", 5}
+
+	var admitted atomic.Int32
+	var wg sync.WaitGroup
+	for range 100 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if wait, _, _ := tracker.attempt(limit); wait == 0 {
+				admitted.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := admitted.Load(); n != int32(limit.threshold) {
+		t.Errorf("%d attempts admitted, want %d", n, limit.threshold)
+	}
+}
+
+func TestLockoutRefund(t *testing.T) {
+	tests := []struct {
+		name      string
+		attempts  int
+		refunds   int
+		threshold int
+		locked    bool
+	}{
+		{name: "refund under threshold", attempts: 2, refunds: 1, threshold: 3},
+		{name: "refund lifts the lockout it triggered", attempts: 3, refunds: 1, threshold: 3},
+		{name: "refund leaves an earlier lockout", attempts: 4, refunds: 1, threshold: 3, locked: true},
+		{name: "refund everything", attempts: 2, refunds: 2, threshold: 3},
+		{name: "refund more than counted", attempts: 1, refunds: 3, threshold: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := newLockoutTracker(time.Minute, time.Hour)
+			limit := lockoutLimit{"room:abc", tt.threshold}
+			for range tt.attempts {
+				tracker.expire(limit.key)
+				tracker.attempt(limit)
+			}
+			for range tt.refunds {
+				tracker.refund(limit)
+			}
+
+			if locked := tracker.waitFor(limit.key) > 0; locked != tt.locked {
+				t.Errorf("locked = %v, want %v", locked, tt.locked)
+			}
+			want := max(tt.attempts-tt.refunds, 0) + 1
+			tracker.expire(limit.key)
+			if _, failures, _ := tracker.attempt(limit); failures[0] != want {
+				t.Errorf("next attempt counts %d failures, want %d", failures[0], want)
+			}
+		})
+	}
+}
+
+func TestLockoutForgetsOldFailures(t *testing.T) {
+	tracker := newLockoutTracker(time.Second, time.Minute)
+	limit := lockoutLimit{"ip:1.2.3.4", 3}
+	tracker.attempt(limit)
+	tracker.attempt(limit)
+
+	tracker.mu.Lock()
+	tracker.records[limit.key].lastFailure = time.Now().Add(-2 * time.Minute)
+	tracker.mu.Unlock()
+
+	if _, failures, locked := tracker.attempt(limit); failures[0] != 1 || locked {
+		t.Errorf("failures = %d, locked = %v, want a fresh count", failures[0], locked)
+	}
+}
+
+func TestCheckJoinPassword(t *testing.T) {
+	hash, err := auth.HashPassword("secret", bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newServer := func() *WebSocketServer {
+		return &WebSocketServer{
+			config: &config.Config{
+				PasswordCost:             bcrypt.MinCost,
+				JoinLockoutIPThreshold:   3,
+				JoinLockoutRoomThreshold: 2,
+			},
+			lockouts: newLockoutTracker(time.Minute, time.Hour),
+		}
+	}
+
+	t.Run("right and wrong passwords", func(t *testing.T) {
+		wss := newServer()
+		if check, _ := wss.checkJoinPassword("abc", "owner", hash, "alice", "1.1.1.1", "secret"); check != joinAllowed {
+			t.Errorf("right password: %v", check)
+		}
+		if check, _ := wss.checkJoinPassword("abc", "owner", hash, "alice", "1.1.1.1", "guess"); check != joinBadPassword {
+			t.Errorf("wrong password: %v", check)
+		}
+	})
+
+	t.Run("room lockout spans IPs but spares the creator", func(t *testing.T) {
+		wss := newServer()
+		wss.checkJoinPassword("abc", "owner", hash, "mallory", "1.1.1.1", "guess")
+		wss.checkJoinPassword("abc", "owner", hash, "mallory", "2.2.2.2", "guess")
+
+		if check, wait := wss.checkJoinPassword("abc", "owner", hash, "alice", "3.3.3.3", "secret"); check != joinLockedOut || wait <= 0 {
+			t.Errorf("member after room lockout: %v, %v", check, wait)
+		}
+		if check, _ := wss.checkJoinPassword("abc", "owner", hash, "owner", "3.3.3.3", "secret"); check != joinAllowed {
+			t.Errorf("creator after room lockout: %v", check)
+		}
+		if check, _ := wss.checkJoinPassword("other", "owner", hash, "alice", "3.3.3.3", "secret"); check != joinAllowed {
+			t.Errorf("other room: %v", check)
+		}
+	})
+
+	t.Run("right password refunds its room attempt", func(t *testing.T) {
+		wss := newServer()
+		wss.checkJoinPassword("abc", "owner", hash, "mallory", "1.1.1.1", "guess")
+		for range 5 {
+			if check, _ := wss.checkJoinPassword("abc", "owner", hash, "alice", "2.2.2.2", "secret"); check != joinAllowed {
+				t.Fatalf("right password: %v", check)
+			}
+		}
+		// Still one failure short of the room threshold
+		if check, _ := wss.checkJoinPassword("abc", "owner", hash, "mallory", "1.1.1.1", "guess"); check != joinBadPassword {
+			t.Errorf("second wrong password: %v", check)
+		}
+		if check, _ := wss.checkJoinPassword("abc", "owner", hash, "alice", "2.2.2.2", "secret"); check != joinLockedOut {
+			t.Errorf("after room lockout: %v", check)
+		}
+	})
+
+	t.Run("right password clears the IP", func(t *testing.T) {
+		wss := newServer()
+		for _, roomID := range []string{"a", "b"} {
+			wss.checkJoinPassword(roomID, "owner", hash, "alice", "1.1.1.1", "guess")
+		}
+		wss.checkJoinPassword("c", "owner", hash, "alice", "1.1.1.1", "secret")
+		for _, roomID := range []string{"d", "e"} {
+			if check, _ := wss.checkJoinPassword(roomID, "owner", hash, "alice", "1.1.1.1", "guess"); check != joinBadPassword {
+				t.Errorf("room %s: %v", roomID, check)
+			}
+		}
+	})
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"portal/internal/models"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "portal"
+
+// roomSizeBuckets are the upper bounds of the members per room histogram.
+var roomSizeBuckets = []float64{1, 2, 3, 4, 6, 8, 12, 16, 24, 32, 50}
+
+// wsMetrics counts what the WebSocket server handles. Gauges are read
+// from live state when scraped instead; see Collect.
+type wsMetrics struct {
+	messages         *prometheus.CounterVec
+	joinFailures     *prometheus.CounterVec
+	signalsForwarded prometheus.Counter
+	signalsDropped   *prometheus.CounterVec
+}
+
+func newWSMetrics() *wsMetrics {
+	return &wsMetrics{
+		messages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "websocket_messages_total",
+			Help:      "WebSocket messages received from clients, by type.",
+		}, []string{"type"}),
+		joinFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "room_join_failures_total",
+			Help:      "Failed join_room requests, by error code.",
+		}, []string{"reason"}),
+		signalsForwarded: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "signals_forwarded_total",
+			Help:      "Signaling messages forwarded to their targets.",
+		}),
+		signalsDropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "signals_dropped_total",
+			Help:      "Signaling messages refused, by error code.",
+		}, []string{"reason"}),
+	}
+}
+
+var (
+	connectionsDesc = prometheus.NewDesc(
+		metricsNamespace+"_websocket_connections",
+		"Open WebSocket connections on this instance.",
+		nil, nil,
+	)
+	detachedDesc = prometheus.NewDesc(
+		metricsNamespace+"_websocket_detached_sessions",
+		"Sessions whose connection dropped, waiting to be resumed.",
+		nil, nil,
+	)
+	roomsDesc = prometheus.NewDesc(
+		metricsNamespace+"_rooms",
+		"Rooms with members on this instance, by visibility.",
+		[]string{"visibility"}, nil,
+	)
+	roomMembersDesc = prometheus.NewDesc(
+		metricsNamespace+"_room_members",
+		"Members per room with members on this instance, counting only those connected here.",
+		nil, nil,
+	)
+	sendDroppedDesc = prometheus.NewDesc(
+		metricsNamespace+"_websocket_send_dropped_total",
+		"Messages discarded from full send queues.",
+		nil, nil,
+	)
+	sendCoalescedDesc = prometheus.NewDesc(
+		metricsNamespace+"_websocket_send_coalesced_total",
+		"ICE candidates merged into signal_candidates in full send queues.",
+		nil, nil,
+	)
+	slowDisconnectsDesc = prometheus.NewDesc(
+		metricsNamespace+"_websocket_slow_disconnects_total",
+		"Clients disconnected for falling behind their send queue.",
+		nil, nil,
+	)
+)
+
+// Describe and Collect make the WebSocket server a prometheus.Collector.
+func (wss *WebSocketServer) Describe(ch chan<- *prometheus.Desc) {
+	prometheus.DescribeByCollect(wss, ch)
+}
+
+func (wss *WebSocketServer) Collect(ch chan<- prometheus.Metric) {
+	wss.mu.RLock()
+	connections, detached := 0, 0
+	for _, client := range wss.clients {
+		if wss.isDetached(client) {
+			detached++
+		} else {
+			connections++
+		}
+	}
+	roomIDs := make([]string, 0, len(wss.rooms))
+	for roomID := range wss.rooms {
+		roomIDs = append(roomIDs, roomID)
+	}
+	wss.mu.RUnlock()
+
+	ch <- prometheus.MustNewConstMetric(connectionsDesc, prometheus.GaugeValue, float64(connections))
+	ch <- prometheus.MustNewConstMetric(detachedDesc, prometheus.GaugeValue, float64(detached))
+
+	var public, private int
+	var members uint64
+	buckets := make(map[float64]uint64, len(roomSizeBuckets))
+	for _, roomID := range roomIDs {
+		room := wss.lockRoom(roomID)
+		if room == nil {
+			continue
+		}
+		size, isPublic := len(room.Members), room.IsPublic
+		room.mu.Unlock()
+
+		if isPublic {
+			public++
+		} else {
+			private++
+		}
+		members += uint64(size)
+		for _, bound := range roomSizeBuckets {
+			if float64(size) <= bound {
+				buckets[bound]++
+			}
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(roomsDesc, prometheus.GaugeValue, float64(public), "public")
+	ch <- prometheus.MustNewConstMetric(roomsDesc, prometheus.GaugeValue, float64(private), "private")
+	ch <- prometheus.MustNewConstHistogram(roomMembersDesc, uint64(public+private), float64(members), buckets)
+
+	stats := wss.SendStats()
+	ch <- prometheus.MustNewConstMetric(sendDroppedDesc, prometheus.CounterValue, float64(stats.Dropped))
+	ch <- prometheus.MustNewConstMetric(sendCoalescedDesc, prometheus.CounterValue, float64(stats.Coalesced))
+	ch <- prometheus.MustNewConstMetric(slowDisconnectsDesc, prometheus.CounterValue, float64(stats.Disconnects))
+
+	wss.metrics.messages.Collect(ch)
+	wss.metrics.joinFailures.Collect(ch)
+	wss.metrics.signalsForwarded.Collect(ch)
+	wss.metrics.signalsDropped.Collect(ch)
+}
+
+// countMessage counts a message received from a client. Unknown types
+// share one label so clients cannot add series at will.
+func (wss *WebSocketServer) countMessage(msgType string) {
+	if _, known := clientPayloads[msgType]; !known {
+		msgType = "unknown"
+	}
+	wss.metrics.messages.WithLabelValues(msgType).Inc()
+}
+
+// joinFailed counts a failed join and tells the client why.
+func (wss *WebSocketServer) joinFailed(client *models.Client, msg models.Message, code, message string) {
+	wss.metrics.joinFailures.WithLabelValues(code).Inc()
+	sendError(client, msg, code, message)
+}
+
+// signalDropped counts a signal that was not forwarded and tells the
+// client why.
+func (wss *WebSocketServer) signalDropped(client *models.Client, msg models.Message, code, message string) {
+	wss.metrics.signalsDropped.WithLabelValues(code).Inc()
+	sendError(client, msg, code, message)
+}
+
+// newRequestDuration is the REST latency histogram, by route pattern.
+func newRequestDuration() *prometheus.HistogramVec {
+	return prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "REST request latency, by method, route and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+}
+
+// observeRequests records how long each request took. WebSocket upgrades
+// are left out, since they last as long as the connection.
+func (s *Server) observeRequests(c *gin.Context) {
+	if c.IsWebsocket() {
+		c.Next()
+		return
+	}
+
+	start := time.Now()
+	c.Next()
+
+	// The pattern rather than the path, so IDs do not add series
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	s.requestDuration.WithLabelValues(
+		c.Request.Method,
+		route,
+		strconv.Itoa(c.Writer.Status()),
+	).Observe(time.Since(start).Seconds())
+}
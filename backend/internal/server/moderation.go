@@ -0,0 +1,242 @@
+package server
+
+import (
+	"log"
+	"portal/internal/models"
+)
+
+var roleRanks = map[string]int{
+	models.RoleMember:    1,
+	models.RoleModerator: 2,
+	models.RoleOwner:     3,
+}
+
+// roleOf returns a user's role in a room.
+func roleOf(room *models.Room, userID string) string {
+	switch {
+	case userID == room.Creator:
+		return models.RoleOwner
+	case room.Moderators[userID]:
+		return models.RoleModerator
+	default:
+		return models.RoleMember
+	}
+}
+
+// canModerate reports whether actorID may kick, ban or mute targetID:
+// moderators and owners may act on anyone ranked below them.
+func canModerate(room *models.Room, actorID, targetID string) bool {
+	actorRank := roleRanks[roleOf(room, actorID)]
+	return actorRank >= roleRanks[models.RoleModerator] && actorRank > roleRanks[roleOf(room, targetID)]
+}
+
+// moderationRoom resolves the live room a moderation message targets and
+// locks it; callers must unlock it when ok is true. The actor must be in
+// the room and may not target themselves.
+func (wss *WebSocketServer) moderationRoom(client *models.Client, msg models.Message, targetID string) (room *liveRoom, ok bool) {
+	room = wss.lockRoom(msg.RoomID)
+	if room == nil || !wss.inRoom(client, msg.RoomID) {
+		if room != nil {
+			room.mu.Unlock()
+		}
+		sendError(client, msg, models.ErrCodeNotInRoom, "You are not in this room")
+		return nil, false
+	}
+	if targetID == client.UserID {
+		room.mu.Unlock()
+		sendError(client, msg, models.ErrCodeForbidden, "You cannot moderate yourself")
+		return nil, false
+	}
+	return room, true
+}
+
+func (wss *WebSocketServer) handleKickMember(client *models.Client, msg models.Message, payload *models.MemberPayload) {
+	targetID := payload.UserID
+	room, ok := wss.moderationRoom(client, msg, targetID)
+	if !ok {
+		return
+	}
+	defer room.mu.Unlock()
+	if !canModerate(room.Room, client.UserID, targetID) {
+		sendError(client, msg, models.ErrCodeForbidden, "You cannot kick this member")
+		return
+	}
+
+	if !wss.removeMember(room, targetID, client.UserID, false) {
+		sendError(client, msg, models.ErrCodeTargetNotInRoom, "User is not in this room")
+		return
+	}
+	sendAck(client, msg)
+}
+
+func (wss *WebSocketServer) handleBanMember(client *models.Client, msg models.Message, payload *models.MemberPayload) {
+	targetID := payload.UserID
+	room, ok := wss.moderationRoom(client, msg, targetID)
+	if !ok {
+		return
+	}
+	defer room.mu.Unlock()
+	if !canModerate(room.Room, client.UserID, targetID) {
+		sendError(client, msg, models.ErrCodeForbidden, "You cannot ban this member")
+		return
+	}
+
+	if err := wss.store.AddBan(room.ID, targetID, client.UserID); err != nil {
+		log.Printf("error banning %s from room %s: %v", targetID, room.ID, err)
+		sendError(client, msg, models.ErrCodeInternal, "Failed to ban member")
+		return
+	}
+	room.Bans[targetID] = true
+
+	wss.removeMember(room, targetID, client.UserID, true)
+	sendAck(client, msg)
+}
+
+func (wss *WebSocketServer) handleUnbanMember(client *models.Client, msg models.Message, payload *models.MemberPayload) {
+	targetID := payload.UserID
+	room, ok := wss.moderationRoom(client, msg, targetID)
+	if !ok {
+		return
+	}
+	defer room.mu.Unlock()
+	if roleRanks[roleOf(room.Room, client.UserID)] < roleRanks[models.RoleModerator] {
+		sendError(client, msg, models.ErrCodeForbidden, "You cannot unban members")
+		return
+	}
+
+	if err := wss.store.RemoveBan(room.ID, targetID); err != nil {
+		log.Printf("error unbanning %s from room %s: %v", targetID, room.ID, err)
+		sendError(client, msg, models.ErrCodeInternal, "Failed to unban member")
+		return
+	}
+	delete(room.Bans, targetID)
+
+	wss.broadcastToRoom(room, models.Message{
+		Type:   models.MessageMemberUnbanned,
+		RoomID: room.ID,
+		UserID: targetID,
+		Payload: models.MemberUnbannedPayload{
+			UserID: targetID,
+			By:     client.UserID,
+		},
+	})
+	sendAck(client, msg)
+}
+
+func (wss *WebSocketServer) handlePromoteMember(client *models.Client, msg models.Message, payload *models.PromoteMemberPayload) {
+	targetID, role := payload.UserID, payload.Role
+	room, ok := wss.moderationRoom(client, msg, targetID)
+	if !ok {
+		return
+	}
+	defer room.mu.Unlock()
+	if roleOf(room.Room, client.UserID) != models.RoleOwner {
+		sendError(client, msg, models.ErrCodeForbidden, "Only the room owner can change roles")
+		return
+	}
+
+	if err := wss.store.SetRole(room.ID, targetID, role); err != nil {
+		log.Printf("error setting role for %s in room %s: %v", targetID, room.ID, err)
+		sendError(client, msg, models.ErrCodeInternal, "Failed to change role")
+		return
+	}
+	if role == models.RoleModerator {
+		room.Moderators[targetID] = true
+	} else {
+		delete(room.Moderators, targetID)
+	}
+
+	wss.broadcastToRoom(room, models.Message{
+		Type:   models.MessageRoleChanged,
+		RoomID: room.ID,
+		UserID: targetID,
+		Payload: models.RoleChangedPayload{
+			UserID: targetID,
+			Role:   role,
+			By:     client.UserID,
+		},
+	})
+	sendAck(client, msg)
+}
+
+func (wss *WebSocketServer) handleMuteMember(client *models.Client, msg models.Message, payload *models.MuteMemberPayload) {
+	targetID := payload.UserID
+	room, ok := wss.moderationRoom(client, msg, targetID)
+	if !ok {
+		return
+	}
+	defer room.mu.Unlock()
+	if !canModerate(room.Room, client.UserID, targetID) {
+		sendError(client, msg, models.ErrCodeForbidden, "You cannot mute this member")
+		return
+	}
+
+	// Mutes last until the room goes idle
+	muted := payload.Muted == nil || *payload.Muted
+	if muted {
+		room.Muted[targetID] = true
+	} else {
+		delete(room.Muted, targetID)
+	}
+	wss.remote.setMuted(room.ID, targetID, muted)
+
+	wss.broadcastToRoom(room, models.Message{
+		Type:   models.MessageMemberMuted,
+		RoomID: room.ID,
+		UserID: targetID,
+		Payload: models.MemberMutedPayload{
+			UserID: targetID,
+			Muted:  muted,
+			By:     client.UserID,
+		},
+	})
+	sendAck(client, msg)
+}
+
+// removeMember announces that targetID was kicked and drops all of their
+// connections from the room, on every instance. It returns false if they
+// were not in it, in which case nothing is announced for a plain kick.
+// Callers must hold room.mu.
+func (wss *WebSocketServer) removeMember(room *liveRoom, targetID, byID string, banned bool) bool {
+	var targets []*models.Client
+	for _, conn := range wss.memberConns(room, targetID) {
+		if member, exists := wss.clientFor(conn); exists {
+			targets = append(targets, member)
+		}
+	}
+	remote := wss.remote.has(room.ID, targetID)
+	if len(targets) == 0 && !remote && !banned {
+		return false
+	}
+
+	// Announce before removing so the kicked member hears it too
+	wss.broadcastToRoom(room, models.Message{
+		Type:   models.MessageMemberKicked,
+		RoomID: room.ID,
+		UserID: targetID,
+		Payload: models.MemberKickedPayload{
+			UserID: targetID,
+			By:     byID,
+			Banned: banned,
+		},
+	})
+
+	for _, target := range targets {
+		wss.removeFromRoom(room, target, false)
+	}
+	wss.remote.kicked(room.ID, targetID)
+	wss.closeIfEmpty(room)
+	return len(targets) > 0 || remote
+}
+
+// inRoom reports whether client has joined roomID.
+func (wss *WebSocketServer) inRoom(client *models.Client, roomID string) bool {
+	wss.mu.RLock()
+	defer wss.mu.RUnlock()
+	for _, id := range client.RoomIDs {
+		if id == roomID {
+			return true
+		}
+	}
+	return false
+}
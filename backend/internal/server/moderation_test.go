@@ -0,0 +1,168 @@
+package server
+
+import (
+	"encoding/json"
+	"portal/internal/auth"
+	"portal/internal/bus"
+	"portal/internal/models"
+	"testing"
+	"time"
+)
+
+// moderatedRoom opens room0001, owned by owner with mod as moderator, and
+// joins each of userIDs to it.
+func moderatedRoom(t *testing.T, userIDs ...string) (*testNode, *memStore, map[string]*testClient) {
+	t.Helper()
+	store := newMemStore()
+	node := newTestNode(t, store, bus.NewLocal(), "node-a")
+	room := &models.Room{ID: "room0001", Name: "Moderated", IsPublic: true, Creator: "owner",
+		Moderators: map[string]bool{"mod": true}, Bans: map[string]bool{}}
+	if err := store.CreateRoom(room); err != nil {
+		t.Fatal(err)
+	}
+
+	clients := make(map[string]*testClient)
+	for _, userID := range userIDs {
+		client := node.dial(t, userID)
+		if msg := client.join("room0001", models.JoinRoomPayload{}); msg.Type != models.MessageRoomJoined {
+			t.Fatalf("%s join: %s %s", userID, msg.Type, msg.errorCode())
+		}
+		clients[userID] = client
+	}
+	return node, store, clients
+}
+
+func TestModerationPermissions(t *testing.T) {
+	tests := []struct {
+		name    string
+		actor   string
+		msgType string
+		payload interface{}
+		code    string
+	}{
+		{name: "member kicks", actor: "alice", msgType: models.MessageKickMember,
+			payload: models.MemberPayload{UserID: "bob"}, code: models.ErrCodeForbidden},
+		{name: "member bans", actor: "alice", msgType: models.MessageBanMember,
+			payload: models.MemberPayload{UserID: "bob"}, code: models.ErrCodeForbidden},
+		{name: "member promotes", actor: "alice", msgType: models.MessagePromoteMember,
+			payload: models.PromoteMemberPayload{UserID: "bob", Role: models.RoleModerator}, code: models.ErrCodeForbidden},
+		{name: "member promotes themselves", actor: "alice", msgType: models.MessagePromoteMember,
+			payload: models.PromoteMemberPayload{UserID: "alice", Role: models.RoleModerator}, code: models.ErrCodeForbidden},
+		{name: "member mutes", actor: "alice", msgType: models.MessageMuteMember,
+			payload: models.MuteMemberPayload{UserID: "bob"}, code: models.ErrCodeForbidden},
+		{name: "member unbans", actor: "alice", msgType: models.MessageUnbanMember,
+			payload: models.MemberPayload{UserID: "bob"}, code: models.ErrCodeForbidden},
+		{name: "moderator promotes", actor: "mod", msgType: models.MessagePromoteMember,
+			payload: models.PromoteMemberPayload{UserID: "bob", Role: models.RoleModerator}, code: models.ErrCodeForbidden},
+		{name: "moderator kicks the owner", actor: "mod", msgType: models.MessageKickMember,
+			payload: models.MemberPayload{UserID: "owner"}, code: models.ErrCodeForbidden},
+		{name: "moderator kicks a member", actor: "mod", msgType: models.MessageKickMember,
+			payload: models.MemberPayload{UserID: "bob"}},
+		{name: "owner bans a moderator", actor: "owner", msgType: models.MessageBanMember,
+			payload: models.MemberPayload{UserID: "mod"}},
+		{name: "owner promotes", actor: "owner", msgType: models.MessagePromoteMember,
+			payload: models.PromoteMemberPayload{UserID: "bob", Role: models.RoleModerator}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, store, clients := moderatedRoom(t, "owner", "mod", "alice", "bob")
+
+			msg := models.Message{Type: tt.msgType, RoomID: "room0001", Payload: tt.payload}
+			if code := clients[tt.actor].request(msg); code != tt.code {
+				t.Fatalf("reply = %q, want %q", code, tt.code)
+			}
+
+			stored, _ := store.GetRoom("room0001")
+			if tt.code != "" {
+				if len(stored.Bans) != 0 || len(stored.Moderators) != 1 {
+					t.Errorf("refused command changed the room: bans %v, moderators %v", stored.Bans, stored.Moderators)
+				}
+			}
+		})
+	}
+}
+
+func TestBanBlocksRejoin(t *testing.T) {
+	node, store, clients := moderatedRoom(t, "owner", "alice")
+
+	ban := models.Message{Type: models.MessageBanMember, RoomID: "room0001", Payload: models.MemberPayload{UserID: "alice"}}
+	if code := clients["owner"].request(ban); code != "" {
+		t.Fatalf("ban: %q", code)
+	}
+	var kicked models.MemberKickedPayload
+	if err := json.Unmarshal(clients["alice"].expect(models.MessageMemberKicked).Payload, &kicked); err != nil {
+		t.Fatal(err)
+	}
+	if kicked.UserID != "alice" || !kicked.Banned {
+		t.Errorf("alice was told %+v", kicked)
+	}
+
+	if msg := clients["alice"].join("room0001", models.JoinRoomPayload{}); msg.errorCode() != models.ErrCodeBanned {
+		t.Errorf("rejoin: %s %q, want %q", msg.Type, msg.errorCode(), models.ErrCodeBanned)
+	}
+
+	invite := &models.Invite{RoomID: "room0001", CreatedBy: "owner", MaxUses: 1, ExpiresAt: time.Now().Add(time.Hour)}
+	store.CreateInvite(invite)
+	token, err := node.keys.Sign(auth.Claims{
+		Subject: invite.ID, Purpose: auth.PurposeInvite, RoomID: "room0001",
+		ExpiresAt: invite.ExpiresAt.Unix(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := clients["alice"].join("room0001", models.JoinRoomPayload{InviteToken: token}); msg.errorCode() != models.ErrCodeBanned {
+		t.Errorf("rejoin with an invite: %s %q, want %q", msg.Type, msg.errorCode(), models.ErrCodeBanned)
+	}
+	if uses := store.inviteUses(invite.ID); uses != 0 {
+		t.Errorf("invite used %d times by a banned member", uses)
+	}
+}
+
+func TestMutedSignalsNotDelivered(t *testing.T) {
+	_, _, clients := moderatedRoom(t, "owner", "alice", "bob")
+	owner, alice, bob := clients["owner"], clients["alice"], clients["bob"]
+
+	mute := func(muted bool) {
+		t.Helper()
+		code := owner.request(models.Message{Type: models.MessageMuteMember, RoomID: "room0001",
+			Payload: models.MuteMemberPayload{UserID: "alice", Muted: &muted}})
+		if code != "" {
+			t.Fatalf("mute %v: %q", muted, code)
+		}
+	}
+	offer := func(from *testClient) string {
+		t.Helper()
+		return from.request(models.Message{Type: models.SignalOffer, RoomID: "room0001",
+			Payload: models.SignalingPayload{SDP: "v=0 " + from.userID, ToUserID: "bob"}})
+	}
+	nextOfferFrom := func() string {
+		t.Helper()
+		var payload models.SignalingPayload
+		if err := json.Unmarshal(bob.expect(models.SignalOffer).Payload, &payload); err != nil {
+			t.Fatal(err)
+		}
+		return payload.FromUserID
+	}
+
+	mute(true)
+	if code := offer(alice); code != models.ErrCodeMuted {
+		t.Fatalf("muted offer: %q, want %q", code, models.ErrCodeMuted)
+	}
+	// The owner's offer is sent after alice's was refused, so it is the
+	// first bob sees unless alice's got through
+	if code := offer(owner); code != "" {
+		t.Fatalf("owner offer: %q", code)
+	}
+	if from := nextOfferFrom(); from != "owner" {
+		t.Fatalf("bob got an offer from %s while alice was muted", from)
+	}
+
+	mute(false)
+	if code := offer(alice); code != "" {
+		t.Fatalf("unmuted offer: %q", code)
+	}
+	if from := nextOfferFrom(); from != "alice" {
+		t.Errorf("bob got an offer from %s, want alice", from)
+	}
+}
@@ -0,0 +1,292 @@
+package server
+
+import (
+	"log"
+	"portal/internal/config"
+	"portal/internal/models"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// SendStats counts messages that slow clients never received.
+type SendStats struct {
+	Dropped     uint64 `json:"dropped"`     // Messages discarded from full queues
+	Coalesced   uint64 `json:"coalesced"`   // Candidates merged into signal_candidates
+	Disconnects uint64 `json:"disconnects"` // Clients closed for falling behind
+}
+
+type sendCounters struct {
+	dropped     atomic.Uint64
+	coalesced   atomic.Uint64
+	disconnects atomic.Uint64
+}
+
+// SendStats returns the slow client counters since the server started.
+func (wss *WebSocketServer) SendStats() SendStats {
+	return SendStats{
+		Dropped:     wss.sendCounters.dropped.Load(),
+		Coalesced:   wss.sendCounters.coalesced.Load(),
+		Disconnects: wss.sendCounters.disconnects.Load(),
+	}
+}
+
+type closeFrame struct {
+	code   int
+	reason string
+}
+
+// outbox is a client's bounded send queue and the goroutine that drains
+// it, which is the only one to write data frames to the connection.
+type outbox struct {
+	client   *models.Client
+	limit    int
+	policy   string
+	counters *sendCounters
+	// batches is set by hello when the client accepts signal_candidates.
+	// push reads it instead of client.Capabilities, which hello writes on
+	// the reader goroutine while others may be sending
+	batches atomic.Bool
+
+	mu      sync.Mutex
+	queue   []models.Message
+	closing *closeFrame
+	stopped bool
+	dropped int // Messages this client lost, for logging
+
+	wake chan struct{}
+	done chan struct{}
+}
+
+// startOutbox gives client an outbox and starts its writer.
+func (wss *WebSocketServer) startOutbox(client *models.Client) *outbox {
+	ob := &outbox{
+		client:   client,
+		limit:    wss.config.SendQueueSize,
+		policy:   wss.config.SlowClientPolicy,
+		counters: &wss.sendCounters,
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	client.Outbox = ob
+	go ob.run()
+	return ob
+}
+
+// Send queues msgs one at a time, applying the slow client policy to each
+// one that does not fit.
+func (ob *outbox) Send(msgs ...models.Message) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	if ob.stopped || ob.closing != nil {
+		return
+	}
+	for i, msg := range msgs {
+		if ob.push(msg) {
+			continue
+		}
+		ob.overflow(1)
+		if ob.stopped {
+			// Disconnected, so the rest are lost with the queue
+			ob.countDropped(len(msgs) - i - 1)
+			return
+		}
+	}
+	ob.notify()
+}
+
+func (ob *outbox) Close(code int, reason string) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	if ob.stopped || ob.closing != nil {
+		return
+	}
+	ob.closing = &closeFrame{code: code, reason: reason}
+	ob.notify()
+}
+
+func (ob *outbox) Done() <-chan struct{} {
+	return ob.done
+}
+
+// stop tells the writer to deliver what is queued and exit, and waits for
+// it a while. The caller closes the connection afterwards.
+func (ob *outbox) stop() {
+	ob.mu.Lock()
+	ob.stopped = true
+	ob.notify()
+	ob.mu.Unlock()
+
+	select {
+	case <-ob.done:
+	case <-time.After(writeWait):
+	}
+
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	if ob.dropped > 0 {
+		log.Printf("client %s lost %d messages to a full send queue", ob.client.UserID, ob.dropped)
+	}
+}
+
+func (ob *outbox) notify() {
+	select {
+	case ob.wake <- struct{}{}:
+	default:
+	}
+}
+
+// push queues msg if it fits, coalescing a full queue first under the
+// coalesce policy, and reports whether it did. Callers must hold ob.mu.
+func (ob *outbox) push(msg models.Message) bool {
+	ob.queue = append(ob.queue, msg)
+	if len(ob.queue) > ob.limit && ob.policy == config.SlowClientCoalesce && ob.batches.Load() {
+		ob.coalesce()
+	}
+	if len(ob.queue) <= ob.limit {
+		return true
+	}
+	// Still full, so msg was not merged into a batch and is last
+	ob.queue = ob.queue[:len(ob.queue)-1]
+	return false
+}
+
+// overflow applies the slow client policy to n messages that did not fit.
+// Callers must hold ob.mu.
+func (ob *outbox) overflow(n int) {
+	if ob.policy != config.SlowClientDisconnect {
+		ob.countDropped(n)
+		return
+	}
+
+	ob.countDropped(n + len(ob.queue))
+	ob.counters.disconnects.Add(1)
+	ob.queue = nil
+	ob.stopped = true
+	ob.notify()
+
+	// The writer may be stuck on this very client, so close from here
+	conn := ob.client.Conn
+	go func() {
+		conn.WriteControl(
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(models.CloseSlowConsumer, "send queue full"),
+			time.Now().Add(time.Second),
+		)
+		conn.Close()
+	}()
+}
+
+// countDropped records n messages this client will never receive. Callers
+// must hold ob.mu.
+func (ob *outbox) countDropped(n int) {
+	ob.dropped += n
+	ob.counters.dropped.Add(uint64(n))
+}
+
+// coalesce merges runs of queued ICE candidates from the same peer and
+// room into signal_candidates messages. A run ends at any other message
+// from that peer in that room, so no candidate overtakes an offer or
+// answer sent after it. Callers must hold ob.mu.
+func (ob *outbox) coalesce() {
+	type source struct{ roomID, userID string }
+	runs := make(map[source]int)
+
+	merged := make([]models.Message, 0, len(ob.queue))
+	for _, msg := range ob.queue {
+		from := source{msg.RoomID, msg.UserID}
+		candidates, ok := queuedCandidates(msg)
+		if !ok {
+			delete(runs, from)
+			merged = append(merged, msg)
+			continue
+		}
+
+		i, exists := runs[from]
+		if !exists {
+			runs[from] = len(merged)
+			merged = append(merged, msg)
+			continue
+		}
+		earlier, _ := queuedCandidates(merged[i])
+		merged[i] = models.Message{
+			Type:   models.SignalCandidates,
+			RoomID: msg.RoomID,
+			UserID: msg.UserID,
+			Payload: models.CandidateBatchPayload{
+				FromUserID: msg.UserID,
+				Candidates: append(append([]models.ICECandidate(nil), earlier...), candidates...),
+			},
+		}
+	}
+
+	ob.counters.coalesced.Add(uint64(len(ob.queue) - len(merged)))
+	ob.queue = merged
+}
+
+// queuedCandidates returns the candidates carried by a queued
+// signal_candidate or signal_candidates message.
+func queuedCandidates(msg models.Message) ([]models.ICECandidate, bool) {
+	switch payload := msg.Payload.(type) {
+	case models.SignalingPayload:
+		if msg.Type == models.SignalCandidate && payload.Candidate != nil {
+			return []models.ICECandidate{*payload.Candidate}, true
+		}
+	case models.CandidateBatchPayload:
+		return payload.Candidates, true
+	}
+	return nil, false
+}
+
+// run writes queued messages until the outbox is stopped or closed, or a
+// write fails.
+func (ob *outbox) run() {
+	defer close(ob.done)
+
+	for range ob.wake {
+		ob.mu.Lock()
+		batch := ob.queue
+		ob.queue = nil
+		closing, stopped := ob.closing, ob.stopped
+		ob.mu.Unlock()
+
+		for _, msg := range batch {
+			if err := ob.write(msg); err != nil {
+				ob.mu.Lock()
+				ob.stopped = true
+				ob.queue = nil
+				ob.mu.Unlock()
+				ob.client.Conn.Close()
+				return
+			}
+		}
+
+		if closing != nil {
+			ob.client.Conn.WriteControl(
+				websocket.CloseMessage,
+				websocket.FormatCloseMessage(closing.code, closing.reason),
+				time.Now().Add(time.Second),
+			)
+			ob.client.Conn.Close()
+			return
+		}
+		if stopped {
+			return
+		}
+	}
+}
+
+// write encodes msg with the client's codec and writes it.
+func (ob *outbox) write(msg models.Message) error {
+	data, err := ob.client.Codec.Marshal(msg)
+	if err != nil {
+		log.Printf("error encoding %s message: %v", msg.Type, err)
+		return nil
+	}
+	ob.client.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return ob.client.Conn.WriteMessage(ob.client.Codec.FrameType(), data)
+}
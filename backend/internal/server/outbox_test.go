@@ -0,0 +1,271 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"portal/internal/config"
+	"portal/internal/models"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// loopbackConn returns one end of a WebSocket connection to a server that
+// accepts it and does nothing else.
+func loopbackConn(t *testing.T) *websocket.Conn {
+	t.Helper()
+	var upgrader websocket.Upgrader
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader.Upgrade(w, r, nil)
+	}))
+	t.Cleanup(srv.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func candidate(from, text string) models.Message {
+	return models.Message{
+		Type:   models.SignalCandidate,
+		RoomID: "room0001",
+		UserID: from,
+		Payload: models.SignalingPayload{
+			Type:       models.SignalCandidate,
+			Candidate:  &models.ICECandidate{Candidate: text},
+			FromUserID: from,
+		},
+	}
+}
+
+func offer(from string) models.Message {
+	return models.Message{
+		Type:    models.SignalOffer,
+		RoomID:  "room0001",
+		UserID:  from,
+		Payload: models.SignalingPayload{Type: models.SignalOffer, SDP: "v=0", FromUserID: from},
+	}
+}
+
+// describe lists queued messages by type, with the candidates a batch
+// carries, such as signal_offer or signal_candidates[c1 c2].
+func describe(queue []models.Message) []string {
+	described := make([]string, len(queue))
+	for i, msg := range queue {
+		described[i] = msg.Type
+		if batch, ok := msg.Payload.(models.CandidateBatchPayload); ok {
+			var texts []string
+			for _, c := range batch.Candidates {
+				texts = append(texts, c.Candidate)
+			}
+			described[i] = fmt.Sprintf("%s%v", msg.Type, texts)
+		}
+	}
+	return described
+}
+
+func TestOutboxSend(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  string
+		batches bool // Client accepts signal_candidates
+		queued  []models.Message
+		send    []models.Message
+
+		want        []string
+		dropped     uint64
+		coalesced   uint64
+		disconnects uint64
+	}{
+		{
+			name:   "fits",
+			policy: config.SlowClientDrop,
+			queued: []models.Message{offer("bob")},
+			send:   []models.Message{candidate("bob", "c1"), candidate("bob", "c2")},
+			want:   []string{models.SignalOffer, models.SignalCandidate, models.SignalCandidate},
+		},
+		{
+			name:    "drop keeps what fits of a batch",
+			policy:  config.SlowClientDrop,
+			queued:  []models.Message{offer("bob")},
+			send:    []models.Message{candidate("bob", "c1"), candidate("bob", "c2"), candidate("bob", "c3")},
+			want:    []string{models.SignalOffer, models.SignalCandidate, models.SignalCandidate},
+			dropped: 1,
+		},
+		{
+			name:    "drop a batch larger than the queue",
+			policy:  config.SlowClientDrop,
+			send:    []models.Message{offer("bob"), offer("carol"), offer("dave"), offer("erin"), offer("frank")},
+			want:    []string{models.SignalOffer, models.SignalOffer, models.SignalOffer},
+			dropped: 2,
+		},
+		{
+			name:      "coalesce a full queue",
+			policy:    config.SlowClientCoalesce,
+			batches:   true,
+			queued:    []models.Message{candidate("bob", "c1"), candidate("bob", "c2"), candidate("bob", "c3")},
+			send:      []models.Message{candidate("bob", "c4")},
+			want:      []string{"signal_candidates[c1 c2 c3 c4]"},
+			coalesced: 3,
+		},
+		{
+			name:      "coalesce each message of a batch",
+			policy:    config.SlowClientCoalesce,
+			batches:   true,
+			queued:    []models.Message{offer("carol"), candidate("bob", "c1"), candidate("bob", "c2")},
+			send:      []models.Message{candidate("bob", "c3"), offer("dave"), candidate("bob", "c4"), offer("erin")},
+			want:      []string{models.SignalOffer, "signal_candidates[c1 c2 c3 c4]", models.SignalOffer},
+			dropped:   1,
+			coalesced: 3,
+		},
+		{
+			name:      "candidates never overtake an offer",
+			policy:    config.SlowClientCoalesce,
+			batches:   true,
+			queued:    []models.Message{candidate("bob", "c1"), offer("bob"), candidate("bob", "c2")},
+			send:      []models.Message{candidate("bob", "c3")},
+			want:      []string{models.SignalCandidate, models.SignalOffer, "signal_candidates[c2 c3]"},
+			coalesced: 1,
+		},
+		{
+			name:      "peers are coalesced apart",
+			policy:    config.SlowClientCoalesce,
+			batches:   true,
+			queued:    []models.Message{candidate("bob", "c1"), candidate("carol", "d1"), candidate("bob", "c2")},
+			send:      []models.Message{candidate("carol", "d2")},
+			want:      []string{"signal_candidates[c1 c2]", "signal_candidates[d1 d2]"},
+			coalesced: 2,
+		},
+		{
+			name:    "coalesce drops when nothing merges",
+			policy:  config.SlowClientCoalesce,
+			batches: true,
+			queued:  []models.Message{offer("bob"), offer("carol"), offer("dave")},
+			send:    []models.Message{candidate("bob", "c1")},
+			want:    []string{models.SignalOffer, models.SignalOffer, models.SignalOffer},
+			dropped: 1,
+		},
+		{
+			name:    "coalesce needs the capability",
+			policy:  config.SlowClientCoalesce,
+			queued:  []models.Message{candidate("bob", "c1"), candidate("bob", "c2"), candidate("bob", "c3")},
+			send:    []models.Message{candidate("bob", "c4")},
+			want:    []string{models.SignalCandidate, models.SignalCandidate, models.SignalCandidate},
+			dropped: 1,
+		},
+		{
+			name:        "disconnect loses the queue and the rest of the batch",
+			policy:      config.SlowClientDisconnect,
+			queued:      []models.Message{offer("bob"), offer("carol")},
+			send:        []models.Message{offer("dave"), offer("erin"), offer("frank")},
+			want:        []string{},
+			dropped:     5,
+			disconnects: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counters := &sendCounters{}
+			ob := &outbox{
+				client:   &models.Client{UserID: "alice", Conn: loopbackConn(t)},
+				limit:    3,
+				policy:   tt.policy,
+				counters: counters,
+				queue:    tt.queued,
+				wake:     make(chan struct{}, 1),
+			}
+			ob.batches.Store(tt.batches)
+
+			ob.Send(tt.send...)
+
+			if got := describe(ob.queue); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("queue = %v, want %v", got, tt.want)
+			}
+			if len(ob.queue) > ob.limit {
+				t.Errorf("queue holds %d messages, over the limit of %d", len(ob.queue), ob.limit)
+			}
+			if n := counters.dropped.Load(); n != tt.dropped || uint64(ob.dropped) != tt.dropped {
+				t.Errorf("dropped = %d (client %d), want %d", n, ob.dropped, tt.dropped)
+			}
+			if n := counters.coalesced.Load(); n != tt.coalesced {
+				t.Errorf("coalesced = %d, want %d", n, tt.coalesced)
+			}
+			if n := counters.disconnects.Load(); n != tt.disconnects {
+				t.Errorf("disconnects = %d, want %d", n, tt.disconnects)
+			}
+			if ob.stopped != (tt.disconnects > 0) {
+				t.Errorf("stopped = %v", ob.stopped)
+			}
+		})
+	}
+}
+
+func TestOutboxIgnoresSendsOnceClosing(t *testing.T) {
+	ob := &outbox{
+		client:   &models.Client{UserID: "alice"},
+		limit:    3,
+		policy:   config.SlowClientDisconnect,
+		counters: &sendCounters{},
+		wake:     make(chan struct{}, 1),
+	}
+	ob.Close(websocket.CloseNormalClosure, "bye")
+	ob.Send(offer("bob"), offer("carol"), offer("dave"), offer("erin"))
+
+	if len(ob.queue) != 0 || ob.counters.disconnects.Load() != 0 {
+		t.Errorf("closing outbox queued %v and disconnected %d times", describe(ob.queue), ob.counters.disconnects.Load())
+	}
+}
+
+// Hello may arrive while other goroutines are already sending, such as a
+// shutdown notice, and must not race them over the capabilities.
+func TestOutboxHelloDuringOverflow(t *testing.T) {
+	client := &models.Client{UserID: "alice", Capabilities: make(map[string]bool)}
+	ob := &outbox{
+		client:   client,
+		limit:    3,
+		policy:   config.SlowClientCoalesce,
+		counters: &sendCounters{},
+		wake:     make(chan struct{}, 1),
+	}
+	client.Outbox = ob
+
+	// Every send overflows the full queue until hello is done
+	ob.Send(candidate("bob", "c1"), candidate("bob", "c2"), candidate("bob", "c3"))
+	started, stop, done := make(chan struct{}), make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			ob.Send(candidate("bob", fmt.Sprintf("c%d", i)))
+			if i == 0 {
+				close(started)
+			}
+			select {
+			case <-stop:
+				return
+			default:
+			}
+		}
+	}()
+	<-started
+	wss := &WebSocketServer{}
+	hello := &models.HelloPayload{Version: models.ProtocolVersion, Capabilities: []string{featureCandidateBatches}}
+	if !wss.handleHello(client, models.Message{Type: models.MessageHello}, hello) {
+		t.Fatal("hello refused")
+	}
+	close(stop)
+	<-done
+
+	// Once hello is in, an overflowing queue is coalesced
+	coalesced := ob.counters.coalesced.Load()
+	ob.Send(candidate("bob", "last"), candidate("bob", "last"), candidate("bob", "last"))
+	if ob.counters.coalesced.Load() == coalesced {
+		t.Errorf("queue %v was not coalesced after hello", describe(ob.queue))
+	}
+}
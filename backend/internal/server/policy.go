@@ -0,0 +1,76 @@
+package server
+
+import (
+	"portal/internal/config"
+	"portal/internal/models"
+)
+
+// admitSession applies the session policy to a new connection. It returns
+// the user's connections here that the new one takes over, or false if
+// the policy turns it away. Connections waiting to be resumed do not
+// count. Callers must hold wss.mu.
+func (wss *WebSocketServer) admitSession(client *models.Client) (replaced []*models.Client, ok bool) {
+	if wss.config.SessionPolicy == config.SessionMultiple {
+		return nil, true
+	}
+
+	for _, other := range wss.clients {
+		if other.UserID == client.UserID && !wss.isDetached(other) {
+			replaced = append(replaced, other)
+		}
+	}
+
+	if wss.config.SessionPolicy == config.SessionReject {
+		active := len(replaced) > 0 || wss.remote.hasSession(client.UserID)
+		return nil, !active
+	}
+	return replaced, true
+}
+
+// rejectSession turns away a connection because its user is already
+// connected.
+func rejectSession(client *models.Client) {
+	sendError(client, models.Message{}, models.ErrCodeSessionActive, "You are already connected somewhere else")
+	client.Outbox.Close(models.CloseSessionRejected, "session already active")
+}
+
+// replaceSession closes a connection whose user connected again. Its rooms
+// are kept for the grace period, the same as a dropped connection, so the
+// new one can resume it.
+func (wss *WebSocketServer) replaceSession(old *models.Client) {
+	send(old, models.Message{Type: models.MessageSessionReplaced})
+	old.Outbox.Close(models.CloseSessionReplaced, "session replaced")
+	wss.detach(old)
+}
+
+// sessionStarted tells the other instances about a new connection, so
+// they can apply the session policy to theirs.
+func (wss *WebSocketServer) sessionStarted(client *models.Client) {
+	wss.publish(clusterEvent{
+		Kind:   eventSessionStarted,
+		UserID: client.UserID,
+		Since:  client.ConnectedAt.UnixNano(),
+	})
+}
+
+// takeOverRemote closes the connections here that a connection to another
+// instance took over. Only older ones are closed, so two instances that
+// each get a connection at the same time agree on which one stays.
+func (wss *WebSocketServer) takeOverRemote(userID string, since int64) {
+	if wss.config.SessionPolicy != config.SessionTakeover {
+		return
+	}
+
+	var replaced []*models.Client
+	wss.mu.RLock()
+	for _, client := range wss.clients {
+		if client.UserID == userID && client.ConnectedAt.UnixNano() < since && !wss.isDetached(client) {
+			replaced = append(replaced, client)
+		}
+	}
+	wss.mu.RUnlock()
+
+	for _, old := range replaced {
+		wss.replaceSession(old)
+	}
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"encoding/json"
+	"portal/internal/bus"
+	"portal/internal/config"
+	"portal/internal/models"
+	"testing"
+	"time"
+)
+
+// policyRoom opens room0001 on a node with the session policy given, joins
+// bob and alice to it, and returns alice's resume token.
+func policyRoom(t *testing.T, policy string) (node *testNode, alice, bob *testClient, token string) {
+	t.Helper()
+	store := newMemStore()
+	node = newTestNode(t, store, bus.NewLocal(), "node-a")
+	// Set before any connection reads them
+	node.wss.config.SessionPolicy = policy
+	node.wss.config.ResumeGracePeriod = time.Minute
+	room := &models.Room{ID: "room0001", Name: "Sessions", IsPublic: true, Creator: "bob",
+		Moderators: map[string]bool{}, Bans: map[string]bool{}}
+	if err := store.CreateRoom(room); err != nil {
+		t.Fatal(err)
+	}
+
+	bob = node.dial(t, "bob")
+	if msg := bob.join("room0001", models.JoinRoomPayload{}); msg.Type != models.MessageRoomJoined {
+		t.Fatalf("bob join: %s %s", msg.Type, msg.errorCode())
+	}
+	alice = node.dial(t, "alice")
+	msg := alice.join("room0001", models.JoinRoomPayload{})
+	if msg.Type != models.MessageRoomJoined {
+		t.Fatalf("alice join: %s %s", msg.Type, msg.errorCode())
+	}
+	var joined models.RoomJoinedPayload
+	if err := json.Unmarshal(msg.Payload, &joined); err != nil {
+		t.Fatal(err)
+	}
+	bob.expect(models.MessageUserJoined)
+	return node, alice, bob, joined.ResumeToken
+}
+
+// connsIn returns how many connections userID has in room0001.
+func (n *testNode) connsIn(t *testing.T, userID string) int {
+	t.Helper()
+	room := n.wss.lockRoom("room0001")
+	if room == nil {
+		t.Fatal("room0001 closed")
+	}
+	defer room.mu.Unlock()
+	return len(n.wss.memberConns(room, userID))
+}
+
+func TestSessionTakeover(t *testing.T) {
+	node, first, bob, token := policyRoom(t, config.SessionTakeover)
+
+	second := node.dial(t, "alice")
+	first.expect(models.MessageSessionReplaced)
+	if code, reason := first.expectClose(); code != models.CloseSessionReplaced || reason != "session replaced" {
+		t.Errorf("first connection closed with %d %q, want %d %q", code, reason, models.CloseSessionReplaced, "session replaced")
+	}
+
+	resumed, _, code := second.resume(token)
+	if code != "" {
+		t.Fatalf("resume on the new connection: %q", code)
+	}
+	if len(resumed.RoomIDs) != 1 || resumed.RoomIDs[0] != "room0001" {
+		t.Errorf("resumed into %v, want [room0001]", resumed.RoomIDs)
+	}
+	if n := node.connsIn(t, "alice"); n != 1 {
+		t.Errorf("alice has %d connections in the room, want 1", n)
+	}
+	bob.signal("v=0 moved")
+	if sdp := sdpOf(second.expect(models.SignalOffer)); sdp != "v=0 moved" {
+		t.Errorf("new connection got offer %q", sdp)
+	}
+}
+
+func TestSessionReject(t *testing.T) {
+	node, first, _, _ := policyRoom(t, config.SessionReject)
+
+	second := node.dial(t, "alice")
+	if code := second.expect(models.MessageError).errorCode(); code != models.ErrCodeSessionActive {
+		t.Errorf("second connection got %q, want %q", code, models.ErrCodeSessionActive)
+	}
+	if code, _ := second.expectClose(); code != models.CloseSessionRejected {
+		t.Errorf("second connection closed with %d, want %d", code, models.CloseSessionRejected)
+	}
+
+	// The first connection carries on as before
+	if n := node.connsIn(t, "alice"); n != 1 {
+		t.Errorf("alice has %d connections in the room, want 1", n)
+	}
+	code := first.request(models.Message{Type: models.SignalOffer, RoomID: "room0001",
+		Payload: models.SignalingPayload{SDP: "v=0", ToUserID: "bob"}})
+	if code != "" {
+		t.Errorf("first connection offer: %q", code)
+	}
+}
+
+func TestSessionMultiple(t *testing.T) {
+	node, first, bob, _ := policyRoom(t, config.SessionMultiple)
+
+	second := node.dial(t, "alice")
+	if msg := second.join("room0001", models.JoinRoomPayload{}); msg.Type != models.MessageRoomJoined {
+		t.Fatalf("second join: %s %s", msg.Type, msg.errorCode())
+	}
+	bob.expect(models.MessageUserJoined)
+
+	if n := node.connsIn(t, "alice"); n != 2 {
+		t.Errorf("alice has %d connections in the room, want 2", n)
+	}
+	for i, client := range []*testClient{first, second} {
+		code := client.request(models.Message{Type: models.SignalOffer, RoomID: "room0001",
+			Payload: models.SignalingPayload{SDP: "v=0", ToUserID: "bob"}})
+		if code != "" {
+			t.Errorf("connection %d offer: %q", i+1, code)
+		}
+	}
+}
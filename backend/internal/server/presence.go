@@ -0,0 +1,108 @@
+package server
+
+import (
+	"portal/internal/models"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// writeWait bounds every write to a client, so a stalled socket cannot hold
+// up a broadcast forever.
+const writeWait = 10 * time.Second
+
+// activity tracks when a connection last sent a message, shared between
+// its read loop and its heartbeat.
+type activity struct {
+	lastActive atomic.Int64 // Unix nanoseconds
+	idle       atomic.Bool
+}
+
+func (a *activity) touch() {
+	a.lastActive.Store(time.Now().UnixNano())
+}
+
+func (a *activity) idleFor() time.Duration {
+	return time.Since(time.Unix(0, a.lastActive.Load()))
+}
+
+// startHeartbeat keeps the read deadline moving while pongs arrive and
+// pings the client every HeartbeatInterval until done is closed. A client
+// that stops answering hits the read deadline, which ends its read loop.
+// It also marks the client idle once it has been quiet for
+// PresenceIdleAfter.
+func (wss *WebSocketServer) startHeartbeat(client *models.Client, seen *activity, done <-chan struct{}) {
+	conn := client.Conn
+	conn.SetReadDeadline(time.Now().Add(wss.config.HeartbeatTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wss.config.HeartbeatTimeout))
+	})
+
+	go func() {
+		ticker := time.NewTicker(wss.config.HeartbeatInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+					return
+				}
+				if wss.config.PresenceIdleAfter > 0 && !seen.idle.Load() && seen.idleFor() >= wss.config.PresenceIdleAfter {
+					seen.idle.Store(true)
+					wss.setPresence(client, models.PresenceOnline, models.PresenceIdle)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// markActive records a message from the client and brings it back online
+// if it had gone idle.
+func (wss *WebSocketServer) markActive(client *models.Client, seen *activity) {
+	client.Conn.SetReadDeadline(time.Now().Add(wss.config.HeartbeatTimeout))
+	seen.touch()
+	if seen.idle.Swap(false) {
+		wss.setPresence(client, models.PresenceIdle, models.PresenceOnline)
+	}
+}
+
+// setPresence changes client's presence to to and tells every room it is
+// in. If from is set, nothing changes unless that is the current presence.
+func (wss *WebSocketServer) setPresence(client *models.Client, from, to string) {
+	wss.mu.Lock()
+	if client.Presence == to || (from != "" && client.Presence != from) {
+		wss.mu.Unlock()
+		return
+	}
+	client.Presence = to
+	roomIDs := append([]string(nil), client.RoomIDs...)
+	wss.mu.Unlock()
+
+	for _, roomID := range roomIDs {
+		room := wss.lockRoom(roomID)
+		if room == nil {
+			continue
+		}
+		wss.broadcastExcept(room, client.Conn, models.Message{
+			Type:   models.MessagePresenceChanged,
+			RoomID: roomID,
+			UserID: client.UserID,
+			Payload: models.PresenceChangedPayload{
+				UserID:   client.UserID,
+				Presence: to,
+			},
+		})
+		room.mu.Unlock()
+	}
+}
+
+// handleSetPresence lets a client say it is away, for example when its tab
+// is hidden, and come back online. Idle is only ever set by the server.
+func (wss *WebSocketServer) handleSetPresence(client *models.Client, msg models.Message, payload *models.SetPresencePayload) {
+	wss.setPresence(client, "", payload.Presence)
+	sendAck(client, msg)
+}
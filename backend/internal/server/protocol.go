@@ -0,0 +1,189 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"portal/internal/models"
+	"portal/internal/schema"
+	"reflect"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+)
+
+var errUnknownType = errors.New("unknown message type")
+
+// protocol lists every WebSocket message type with its payload struct. It
+// drives payload decoding and the schema served at /api/schema, so a new
+// message type only needs adding here and to the dispatch switch.
+var protocol = []schema.Message{
+	{Type: models.MessageHello, Payload: reflect.TypeOf(models.HelloPayload{}), FromClient: true},
+	{Type: models.MessageResume, Payload: reflect.TypeOf(models.ResumePayload{}), FromClient: true},
+	{Type: models.MessageSetPresence, Payload: reflect.TypeOf(models.SetPresencePayload{}), FromClient: true},
+	{Type: models.MessageJoinRoom, Payload: reflect.TypeOf(models.JoinRoomPayload{}), FromClient: true},
+	{Type: models.MessageCreateRoom, Payload: reflect.TypeOf(models.CreateRoomPayload{}), FromClient: true},
+	{Type: models.MessageLeaveRoom, FromClient: true},
+	{Type: models.MessageSignal, Payload: reflect.TypeOf(models.LegacySignalPayload{}), FromClient: true, FromServer: true},
+	{Type: models.SignalOffer, Payload: reflect.TypeOf(models.SignalingPayload{}), FromClient: true, FromServer: true},
+	{Type: models.SignalAnswer, Payload: reflect.TypeOf(models.SignalingPayload{}), FromClient: true, FromServer: true},
+	{Type: models.SignalCandidate, Payload: reflect.TypeOf(models.SignalingPayload{}), FromClient: true, FromServer: true},
+	{Type: models.SignalCandidates, Payload: reflect.TypeOf(models.CandidateBatchPayload{}), FromServer: true},
+	{Type: models.MessageKickMember, Payload: reflect.TypeOf(models.MemberPayload{}), FromClient: true},
+	{Type: models.MessageBanMember, Payload: reflect.TypeOf(models.MemberPayload{}), FromClient: true},
+	{Type: models.MessageUnbanMember, Payload: reflect.TypeOf(models.MemberPayload{}), FromClient: true},
+	{Type: models.MessagePromoteMember, Payload: reflect.TypeOf(models.PromoteMemberPayload{}), FromClient: true},
+	{Type: models.MessageMuteMember, Payload: reflect.TypeOf(models.MuteMemberPayload{}), FromClient: true},
+
+	{Type: models.MessageWelcome, Payload: reflect.TypeOf(models.WelcomePayload{}), FromServer: true},
+	{Type: models.MessageAck, Payload: reflect.TypeOf(models.AckPayload{}), FromServer: true},
+	{Type: models.MessageError, Payload: reflect.TypeOf(models.ErrorPayload{}), FromServer: true},
+	{Type: models.MessageSessionResumed, Payload: reflect.TypeOf(models.SessionResumedPayload{}), FromServer: true},
+	{Type: models.MessageRoomNotFound, Payload: reflect.TypeOf(models.RoomNotFoundPayload{}), FromServer: true},
+	{Type: models.MessageRoomJoined, Payload: reflect.TypeOf(models.RoomJoinedPayload{}), FromServer: true},
+	{Type: models.MessageRoomCreated, Payload: reflect.TypeOf(models.RoomCreatedPayload{}), FromServer: true},
+	{Type: models.MessageUserJoined, Payload: reflect.TypeOf(models.UserJoinedPayload{}), FromServer: true},
+	{Type: models.MessageUserLeft, Payload: reflect.TypeOf(models.MemberInfo{}), FromServer: true},
+	{Type: models.MessageMemberKicked, Payload: reflect.TypeOf(models.MemberKickedPayload{}), FromServer: true},
+	{Type: models.MessageMemberUnbanned, Payload: reflect.TypeOf(models.MemberUnbannedPayload{}), FromServer: true},
+	{Type: models.MessageRoleChanged, Payload: reflect.TypeOf(models.RoleChangedPayload{}), FromServer: true},
+	{Type: models.MessageMemberMuted, Payload: reflect.TypeOf(models.MemberMutedPayload{}), FromServer: true},
+	{Type: models.MessagePresenceChanged, Payload: reflect.TypeOf(models.PresenceChangedPayload{}), FromServer: true},
+	{Type: models.MessageJoinAttemptsFailed, Payload: reflect.TypeOf(models.JoinAttemptsFailedPayload{}), FromServer: true},
+	{Type: models.MessageServerShutdown, Payload: reflect.TypeOf(models.ServerShutdownPayload{}), FromServer: true},
+	{Type: models.MessageSessionReplaced, FromServer: true},
+}
+
+// clientPayloads and serverPayloads map each type a client or the server
+// may send to its payload struct, nil for messages without one.
+var (
+	clientPayloads = make(map[string]reflect.Type)
+	serverPayloads = make(map[string]reflect.Type)
+)
+
+func init() {
+	for _, msg := range protocol {
+		if msg.FromClient {
+			clientPayloads[msg.Type] = msg.Payload
+		}
+		if msg.FromServer {
+			serverPayloads[msg.Type] = msg.Payload
+		}
+	}
+}
+
+// protocolSchema is the JSON Schema served at /api/schema.
+var protocolSchema = schema.Generate("Portal WebSocket protocol", reflect.TypeOf(models.Message{}), protocol)
+
+// GetSchema serves the JSON Schema for the WebSocket protocol, so clients
+// can generate their message types from it.
+func (s *Server) GetSchema(c *gin.Context) {
+	c.Header("Content-Type", "application/schema+json")
+	c.JSON(http.StatusOK, protocolSchema)
+}
+
+var validate = newValidator()
+
+func newValidator() *validator.Validate {
+	v := validator.New(validator.WithRequiredStructEnabled())
+	// Report fields by the names clients send
+	v.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+	return v
+}
+
+// decodeClientPayload decodes and validates a client message's payload
+// into its registered struct and returns a pointer to it, or nil if the
+// message takes no payload.
+func decodeClientPayload(msg models.Message) (interface{}, error) {
+	payloadType, known := clientPayloads[msg.Type]
+	if !known {
+		return nil, errUnknownType
+	}
+	if payloadType == nil {
+		return nil, nil
+	}
+
+	payload := reflect.New(payloadType).Interface()
+	if err := decodePayload(msg.Payload, payload); err != nil {
+		return nil, err
+	}
+	if payloadType.Kind() == reflect.Struct {
+		if err := validate.Struct(payload); err != nil {
+			return nil, err
+		}
+	}
+	return payload, nil
+}
+
+// decodeServerPayload turns the generically decoded payload of a message
+// the server sent back into its registered struct, as it was before
+// crossing the cluster bus.
+func decodeServerPayload(msg *models.Message) error {
+	payloadType, known := serverPayloads[msg.Type]
+	if !known {
+		return errUnknownType
+	}
+	if payloadType == nil || msg.Payload == nil {
+		return nil
+	}
+
+	payload := reflect.New(payloadType)
+	if err := decodePayload(msg.Payload, payload.Interface()); err != nil {
+		return err
+	}
+	msg.Payload = payload.Elem().Interface()
+	return nil
+}
+
+// sendPayloadError reports why decodeClientPayload rejected msg.
+func sendPayloadError(client *models.Client, msg models.Message, err error) {
+	if errors.Is(err, errUnknownType) {
+		sendError(client, msg, models.ErrCodeUnknownType, "Unknown message type")
+		return
+	}
+
+	fields := payloadFieldErrors(err)
+	if fields == nil {
+		sendError(client, msg, models.ErrCodeInvalidPayload, "Invalid payload")
+		return
+	}
+	sendErrorPayload(client, msg, models.ErrorPayload{
+		Code:    models.ErrCodeInvalidPayload,
+		Message: "Invalid payload",
+		Details: map[string]interface{}{"fields": fields},
+	})
+}
+
+// payloadFieldErrors lists the fields a payload failed on, or nil if err
+// does not point at any.
+func payloadFieldErrors(err error) []models.FieldError {
+	var fields []models.FieldError
+	var invalid validator.ValidationErrors
+	var mistyped *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &invalid):
+		for _, fieldErr := range invalid {
+			// Drop the struct name so the path starts at the payload
+			_, path, _ := strings.Cut(fieldErr.Namespace(), ".")
+			fields = append(fields, models.FieldError{
+				Field: path,
+				Rule:  fieldErr.Tag(),
+				Param: fieldErr.Param(),
+			})
+		}
+	case errors.As(err, &mistyped):
+		fields = append(fields, models.FieldError{
+			Field: mistyped.Field,
+			Rule:  "type",
+			Param: mistyped.Type.String(),
+		})
+	}
+	return fields
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"portal/internal/models"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeClientPayload(t *testing.T) {
+	long := func(n int) string { return `"` + strings.Repeat("a", n) + `"` }
+
+	tests := []struct {
+		name    string
+		msgType string
+		payload string // JSON, decoded generically first as a codec would
+		want    interface{}
+		err     error
+		fields  []models.FieldError
+	}{
+		{name: "unknown type", msgType: "teleport", payload: `{}`, err: errUnknownType},
+		{name: "server-only type", msgType: models.MessageRoomJoined, payload: `{}`, err: errUnknownType},
+		{name: "no payload", msgType: models.MessageLeaveRoom, payload: `null`},
+
+		{name: "hello", msgType: models.MessageHello, payload: `{"version":2,"capabilities":["candidate_batches"]}`,
+			want: &models.HelloPayload{Version: 2, Capabilities: []string{"candidate_batches"}}},
+		{name: "hello without version", msgType: models.MessageHello, payload: `{}`,
+			fields: []models.FieldError{{Field: "version", Rule: "required"}}},
+		{name: "hello with a long capability", msgType: models.MessageHello, payload: `{"version":1,"capabilities":["ok",` + long(65) + `]}`,
+			fields: []models.FieldError{{Field: "capabilities[1]", Rule: "max", Param: "64"}}},
+		{name: "hello with a string version", msgType: models.MessageHello, payload: `{"version":"2"}`,
+			fields: []models.FieldError{{Field: "version", Rule: "type", Param: "int"}}},
+
+		{name: "join", msgType: models.MessageJoinRoom, payload: `{"password":"secret","username":"alice"}`,
+			want: &models.JoinRoomPayload{Password: "secret", Username: "alice"}},
+		{name: "join with a long invite", msgType: models.MessageJoinRoom, payload: `{"inviteToken":` + long(1025) + `}`,
+			fields: []models.FieldError{{Field: "inviteToken", Rule: "max", Param: "1024"}}},
+
+		{name: "presence", msgType: models.MessageSetPresence, payload: `{"presence":"away"}`,
+			want: &models.SetPresencePayload{Presence: "away"}},
+		{name: "unknown presence", msgType: models.MessageSetPresence, payload: `{"presence":"busy"}`,
+			fields: []models.FieldError{{Field: "presence", Rule: "oneof", Param: "online away"}}},
+
+		{name: "promote", msgType: models.MessagePromoteMember, payload: `{"userId":"bob","role":"moderator"}`,
+			want: &models.PromoteMemberPayload{UserID: "bob", Role: models.RoleModerator}},
+		{name: "promote to owner", msgType: models.MessagePromoteMember, payload: `{"userId":"bob","role":"owner"}`,
+			fields: []models.FieldError{{Field: "role", Rule: "oneof", Param: "moderator member"}}},
+		{name: "kick nobody", msgType: models.MessageKickMember, payload: `{}`,
+			fields: []models.FieldError{{Field: "userId", Rule: "required"}}},
+
+		{name: "oversized SDP", msgType: models.SignalOffer, payload: `{"sdp":` + long(65537) + `}`,
+			fields: []models.FieldError{{Field: "sdp", Rule: "max", Param: "65536"}}},
+		{name: "candidate with a negative line", msgType: models.SignalCandidate, payload: `{"candidate":{"candidate":"c","sdpMLineIndex":-1}}`,
+			fields: []models.FieldError{{Field: "candidate.sdpMLineIndex", Rule: "min", Param: "0"}}},
+		{name: "legacy signal passes through", msgType: models.MessageSignal, payload: `{"toUserId":"bob","sdp":"x"}`,
+			want: &models.LegacySignalPayload{"toUserId": "bob", "sdp": "x"}},
+		{name: "payload that is not an object", msgType: models.MessageJoinRoom, payload: `"join"`,
+			fields: []models.FieldError{{Field: "", Rule: "type", Param: "models.JoinRoomPayload"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var generic interface{}
+			if err := json.Unmarshal([]byte(tt.payload), &generic); err != nil {
+				t.Fatal(err)
+			}
+
+			payload, err := decodeClientPayload(models.Message{Type: tt.msgType, Payload: generic})
+			if tt.err != nil || tt.fields != nil {
+				if tt.err != nil && !errors.Is(err, tt.err) {
+					t.Fatalf("err = %v, want %v", err, tt.err)
+				}
+				if fields := payloadFieldErrors(err); !reflect.DeepEqual(fields, tt.fields) {
+					t.Fatalf("fields = %+v, want %+v", fields, tt.fields)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("err = %v", err)
+			}
+			if tt.want == nil && payload != nil {
+				t.Fatalf("payload = %#v, want none", payload)
+			}
+			if tt.want != nil && !reflect.DeepEqual(payload, tt.want) {
+				t.Errorf("payload = %#v, want %#v", payload, tt.want)
+			}
+		})
+	}
+}
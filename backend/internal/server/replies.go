@@ -0,0 +1,51 @@
+package server
+
+import (
+	"portal/internal/models"
+
+	"github.com/gorilla/websocket"
+)
+
+// send queues msg for the client's writer.
+func send(client *models.Client, msg models.Message) {
+	client.Outbox.Send(msg)
+}
+
+// sendTo sends msg to whichever client owns conn, or buffers it if that
+// client is waiting to be resumed. Callers must not hold wss.mu.
+func (wss *WebSocketServer) sendTo(conn *websocket.Conn, msg models.Message) {
+	if client, exists := wss.clientFor(conn); exists && !wss.buffer(client, msg) {
+		send(client, msg)
+	}
+}
+
+// reply sends msg to client in response to req, echoing the request ID.
+func reply(client *models.Client, req models.Message, msg models.Message) {
+	msg.ID = req.ID
+	send(client, msg)
+}
+
+// sendAck confirms that req took effect.
+func sendAck(client *models.Client, req models.Message) {
+	reply(client, req, models.Message{
+		Type:    models.MessageAck,
+		RoomID:  req.RoomID,
+		Payload: models.AckPayload{Type: req.Type},
+	})
+}
+
+// sendError reports that req failed with one of the models.ErrCode codes.
+func sendError(client *models.Client, req models.Message, code, message string) {
+	sendErrorPayload(client, req, models.ErrorPayload{
+		Code:    code,
+		Message: message,
+	})
+}
+
+func sendErrorPayload(client *models.Client, req models.Message, payload models.ErrorPayload) {
+	reply(client, req, models.Message{
+		Type:    models.MessageError,
+		RoomID:  req.RoomID,
+		Payload: payload,
+	})
+}
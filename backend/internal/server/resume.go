@@ -0,0 +1,244 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"portal/internal/models"
+	"slices"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// maxResumeBuffer bounds how many messages are kept for a disconnected
+// client. Older ones are dropped first, and the client is told how many it
+// lost so it can renegotiate.
+const maxResumeBuffer = 256
+
+// resumeBufferSize is how many messages a detached client keeps: no more
+// than fit its new send queue between session_resumed and the ack, so the
+// replay is never cut short by the slow client policy.
+func (wss *WebSocketServer) resumeBufferSize() int {
+	return min(maxResumeBuffer, wss.config.SendQueueSize-2)
+}
+
+// detachedSession is a client whose connection dropped but whose room
+// memberships are kept until expiry fires or a new connection resumes it.
+type detachedSession struct {
+	pending []models.Message
+	dropped int
+	expiry  *time.Timer
+}
+
+// resumeToken returns client's resume token, issuing one on first use.
+// Callers must hold wss.mu.
+func (wss *WebSocketServer) resumeToken(client *models.Client) string {
+	if client.ResumeToken == "" {
+		token := make([]byte, 32)
+		rand.Read(token)
+		client.ResumeToken = base64.RawURLEncoding.EncodeToString(token)
+		wss.sessions[client.ResumeToken] = client
+	}
+	return client.ResumeToken
+}
+
+// isDetached reports whether client lost its connection and is waiting to
+// be resumed.
+func (wss *WebSocketServer) isDetached(client *models.Client) bool {
+	wss.resumeMu.Lock()
+	defer wss.resumeMu.Unlock()
+	_, detached := wss.detached[client]
+	return detached
+}
+
+// buffer keeps msg for a detached client and reports whether it did, so
+// the caller knows not to write it.
+func (wss *WebSocketServer) buffer(client *models.Client, msg models.Message) bool {
+	wss.resumeMu.Lock()
+	defer wss.resumeMu.Unlock()
+
+	session, detached := wss.detached[client]
+	if !detached {
+		return false
+	}
+	if len(session.pending) >= wss.resumeBufferSize() {
+		session.pending = session.pending[1:]
+		session.dropped++
+	}
+	session.pending = append(session.pending, msg)
+	return true
+}
+
+// detach handles a client whose connection is gone. Clients in rooms keep
+// their memberships for the grace period; everyone else is removed
+// straight away.
+func (wss *WebSocketServer) detach(client *models.Client) {
+	if wss.config.ResumeGracePeriod <= 0 || len(wss.roomIDsOf(client)) == 0 {
+		wss.removeClient(client)
+		return
+	}
+
+	wss.resumeMu.Lock()
+	_, detached := wss.detached[client]
+	if !detached {
+		wss.detached[client] = &detachedSession{
+			expiry: time.AfterFunc(wss.config.ResumeGracePeriod, func() {
+				wss.expireSession(client)
+			}),
+		}
+	}
+	wss.resumeMu.Unlock()
+
+	if !detached {
+		wss.setPresence(client, "", models.PresenceAway)
+	}
+}
+
+// expireSession removes a detached client nobody resumed in time.
+func (wss *WebSocketServer) expireSession(client *models.Client) {
+	wss.resumeMu.Lock()
+	_, detached := wss.detached[client]
+	delete(wss.detached, client)
+	wss.resumeMu.Unlock()
+
+	// Resumed just before the timer fired
+	if !detached {
+		return
+	}
+
+	wss.removeClient(client)
+	go wss.touchUser(client.UserID)
+}
+
+// removeClient drops client from its rooms, telling the other members, and
+// forgets it. Callers must not hold any room lock, unless client is in no
+// rooms.
+func (wss *WebSocketServer) removeClient(client *models.Client) {
+	wss.removeClientFromAllRooms(client)
+
+	wss.mu.Lock()
+	defer wss.mu.Unlock()
+	delete(wss.clients, client.Conn)
+	if wss.sessions[client.ResumeToken] == client {
+		delete(wss.sessions, client.ResumeToken)
+	}
+}
+
+// dropDetachedMember removes userID's detached sessions from room when they
+// join it again on a new connection, here or on another instance, so the
+// room does not list them twice. Nobody is told, since the user never
+// really left. Callers must hold room.mu.
+func (wss *WebSocketServer) dropDetachedMember(room *liveRoom, userID string) {
+	for _, conn := range wss.memberConns(room, userID) {
+		member, exists := wss.clientFor(conn)
+		if !exists || !wss.isDetached(member) {
+			continue
+		}
+
+		wss.removeFromRoom(room, member, false)
+		wss.publish(clusterEvent{Kind: eventMemberDropped, RoomID: room.ID, UserID: userID})
+		if len(wss.roomIDsOf(member)) > 0 {
+			continue
+		}
+
+		// Nothing left to resume
+		wss.resumeMu.Lock()
+		if session, detached := wss.detached[member]; detached {
+			session.expiry.Stop()
+			delete(wss.detached, member)
+		}
+		wss.resumeMu.Unlock()
+		wss.removeClient(member)
+	}
+}
+
+// handleResume lets a fresh connection take over the session named by a
+// resume token: its room memberships and the messages it missed. The old
+// connection is closed if it is somehow still open.
+func (wss *WebSocketServer) handleResume(client *models.Client, msg models.Message, payload *models.ResumePayload) {
+	var old *models.Client
+	var rooms []*liveRoom
+	for {
+		wss.mu.RLock()
+		var exists bool
+		old, exists = wss.sessions[payload.Token]
+		var roomIDs []string
+		if exists {
+			roomIDs = append(roomIDs, old.RoomIDs...)
+		}
+		joined := len(client.RoomIDs) > 0
+		wss.mu.RUnlock()
+
+		if !exists || old == client || old.UserID != client.UserID {
+			sendError(client, msg, models.ErrCodeResumeFailed, "Session expired or not found")
+			return
+		}
+		if joined {
+			sendError(client, msg, models.ErrCodeInvalidMessage, "resume must be sent before joining a room")
+			return
+		}
+
+		// Hold every room in the session while it moves, so nothing sent
+		// to them is lost or overtakes the replay
+		rooms = wss.lockRooms(roomIDs)
+		wss.mu.Lock()
+		if wss.sessions[payload.Token] == old && slices.Equal(old.RoomIDs, roomIDs) {
+			break
+		}
+		// The session changed before the rooms were locked
+		wss.mu.Unlock()
+		unlockRooms(rooms)
+	}
+
+	wss.resumeMu.Lock()
+	session, detached := wss.detached[old]
+	delete(wss.detached, old)
+	wss.resumeMu.Unlock()
+
+	if detached {
+		session.expiry.Stop()
+	} else {
+		old.Outbox.Close(websocket.ClosePolicyViolation, "session resumed elsewhere")
+		session = &detachedSession{}
+	}
+
+	// Move the session onto this connection
+	client.Username = old.Username
+	client.AvatarID = old.AvatarID
+	client.RoomIDs = old.RoomIDs
+	client.ResumeToken = old.ResumeToken
+	client.Presence = old.Presence
+	old.RoomIDs = nil
+	wss.sessions[client.ResumeToken] = client
+	delete(wss.clients, old.Conn)
+	roomIDs := append([]string(nil), client.RoomIDs...)
+	wss.mu.Unlock()
+
+	for _, room := range rooms {
+		delete(room.Members, old.Conn)
+		room.Members[client.Conn] = client.Username
+	}
+
+	// Sized by resumeBufferSize to fit the queue, which holds at most
+	// replies to this roomless connection's own messages
+	replay := make([]models.Message, 0, len(session.pending)+2)
+	replay = append(replay, models.Message{
+		ID:   msg.ID,
+		Type: models.MessageSessionResumed,
+		Payload: models.SessionResumedPayload{
+			RoomIDs: roomIDs,
+			Missed:  len(session.pending),
+			Dropped: session.dropped,
+		},
+	})
+	replay = append(replay, session.pending...)
+	replay = append(replay, models.Message{
+		ID:      msg.ID,
+		Type:    models.MessageAck,
+		Payload: models.AckPayload{Type: msg.Type},
+	})
+	client.Outbox.Send(replay...)
+	unlockRooms(rooms)
+
+	wss.setPresence(client, "", models.PresenceOnline)
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"encoding/json"
+	"portal/internal/bus"
+	"portal/internal/models"
+	"testing"
+	"time"
+)
+
+// detachedRoom opens room0001 on a node keeping sessions for grace, joins
+// bob and then alice, and drops alice's connection. It returns once bob
+// has seen her go away, along with her resume token.
+func detachedRoom(t *testing.T, grace time.Duration) (node *testNode, bob *testClient, token string) {
+	t.Helper()
+	store := newMemStore()
+	node = newTestNode(t, store, bus.NewLocal(), "node-a")
+	// Set before any connection reads it
+	node.wss.config.ResumeGracePeriod = grace
+	room := &models.Room{ID: "room0001", Name: "Resumable", IsPublic: true, Creator: "bob",
+		Moderators: map[string]bool{}, Bans: map[string]bool{}}
+	if err := store.CreateRoom(room); err != nil {
+		t.Fatal(err)
+	}
+
+	bob = node.dial(t, "bob")
+	if msg := bob.join("room0001", models.JoinRoomPayload{}); msg.Type != models.MessageRoomJoined {
+		t.Fatalf("bob join: %s %s", msg.Type, msg.errorCode())
+	}
+	alice := node.dial(t, "alice")
+	msg := alice.join("room0001", models.JoinRoomPayload{})
+	if msg.Type != models.MessageRoomJoined {
+		t.Fatalf("alice join: %s %s", msg.Type, msg.errorCode())
+	}
+	var joined models.RoomJoinedPayload
+	if err := json.Unmarshal(msg.Payload, &joined); err != nil {
+		t.Fatal(err)
+	}
+	bob.expect(models.MessageUserJoined)
+
+	alice.conn.Close()
+	var presence models.PresenceChangedPayload
+	if err := json.Unmarshal(bob.expect(models.MessagePresenceChanged).Payload, &presence); err != nil {
+		t.Fatal(err)
+	}
+	if presence.UserID != "alice" || presence.Presence != models.PresenceAway {
+		t.Fatalf("bob saw %+v, want alice away", presence)
+	}
+	return node, bob, joined.ResumeToken
+}
+
+// resume sends a resume with token and returns the session_resumed payload
+// and the messages replayed after it, or the error code instead.
+func (c *testClient) resume(token string) (resumed models.SessionResumedPayload, replayed []received, code string) {
+	c.t.Helper()
+	c.send(models.Message{ID: "resume", Type: models.MessageResume, Payload: models.ResumePayload{Token: token}})
+
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var msg received
+		if err := c.conn.ReadJSON(&msg); err != nil {
+			c.t.Fatalf("%s resuming: %v", c.userID, err)
+		}
+		switch {
+		case msg.ID == "resume" && msg.Type == models.MessageError:
+			return resumed, nil, msg.errorCode()
+		case msg.ID == "resume" && msg.Type == models.MessageAck:
+			return resumed, replayed, ""
+		case msg.Type == models.MessageSessionResumed:
+			if err := json.Unmarshal(msg.Payload, &resumed); err != nil {
+				c.t.Fatal(err)
+			}
+		default:
+			replayed = append(replayed, msg)
+		}
+	}
+}
+
+// signal sends alice an offer carrying sdp and waits for the ack.
+func (c *testClient) signal(sdp string) {
+	c.t.Helper()
+	code := c.request(models.Message{Type: models.SignalOffer, RoomID: "room0001",
+		Payload: models.SignalingPayload{SDP: sdp, ToUserID: "alice"}})
+	if code != "" {
+		c.t.Fatalf("%s offer %s: %q", c.userID, sdp, code)
+	}
+}
+
+func sdpOf(msg received) string {
+	var payload models.SignalingPayload
+	json.Unmarshal(msg.Payload, &payload)
+	return payload.SDP
+}
+
+func TestResumeReplaysMissedMessages(t *testing.T) {
+	node, bob, token := detachedRoom(t, time.Minute)
+
+	sent := []string{"v=0 1", "v=0 2", "v=0 3"}
+	for _, sdp := range sent {
+		bob.signal(sdp)
+	}
+
+	alice := node.dial(t, "alice")
+	resumed, replayed, code := alice.resume(token)
+	if code != "" {
+		t.Fatalf("resume: %q", code)
+	}
+	if len(resumed.RoomIDs) != 1 || resumed.RoomIDs[0] != "room0001" {
+		t.Errorf("resumed into %v, want [room0001]", resumed.RoomIDs)
+	}
+	if resumed.Missed != len(replayed) || resumed.Dropped != 0 {
+		t.Errorf("told %d missed and %d dropped, replayed %d", resumed.Missed, resumed.Dropped, len(replayed))
+	}
+
+	var got []string
+	for _, msg := range replayed {
+		if msg.Type == models.SignalOffer {
+			got = append(got, sdpOf(msg))
+		}
+	}
+	if len(got) != len(sent) {
+		t.Fatalf("replayed offers %q, want %q", got, sent)
+	}
+	for i := range sent {
+		if got[i] != sent[i] {
+			t.Errorf("replayed offers %q, want %q", got, sent)
+			break
+		}
+	}
+
+	var presence models.PresenceChangedPayload
+	if err := json.Unmarshal(bob.expect(models.MessagePresenceChanged).Payload, &presence); err != nil {
+		t.Fatal(err)
+	}
+	if presence.UserID != "alice" || presence.Presence != models.PresenceOnline {
+		t.Errorf("bob saw %+v, want alice online", presence)
+	}
+
+	// Still a member: signals reach the new connection straight away
+	bob.signal("v=0 live")
+	if sdp := sdpOf(alice.expect(models.SignalOffer)); sdp != "v=0 live" {
+		t.Errorf("alice got offer %q, want the live one", sdp)
+	}
+}
+
+func TestResumeAfterGracePeriod(t *testing.T) {
+	node, bob, token := detachedRoom(t, 50*time.Millisecond)
+
+	var left models.MemberInfo
+	if err := json.Unmarshal(bob.expect(models.MessageUserLeft).Payload, &left); err != nil {
+		t.Fatal(err)
+	}
+	if left.UserID != "alice" {
+		t.Fatalf("bob saw %q leave, want alice", left.UserID)
+	}
+
+	alice := node.dial(t, "alice")
+	if _, _, code := alice.resume(token); code != models.ErrCodeResumeFailed {
+		t.Errorf("resume after the grace period: %q, want %q", code, models.ErrCodeResumeFailed)
+	}
+}
+
+func TestResumeOtherUsersSession(t *testing.T) {
+	node, bob, token := detachedRoom(t, time.Minute)
+
+	mallory := node.dial(t, "mallory")
+	if _, _, code := mallory.resume(token); code != models.ErrCodeResumeFailed {
+		t.Fatalf("mallory resumed alice's session: %q, want %q", code, models.ErrCodeResumeFailed)
+	}
+	if code := mallory.request(models.Message{Type: models.SignalOffer, RoomID: "room0001",
+		Payload: models.SignalingPayload{SDP: "v=0", ToUserID: "bob"}}); code == "" {
+		t.Error("mallory can signal in alice's room")
+	}
+
+	// The failed attempt leaves the session for alice
+	bob.signal("v=0 1")
+	alice := node.dial(t, "alice")
+	if _, replayed, code := alice.resume(token); code != "" || len(replayed) == 0 {
+		t.Errorf("alice resume after mallory's attempt: %q, %d replayed", code, len(replayed))
+	}
+}
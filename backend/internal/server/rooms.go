@@ -0,0 +1,203 @@
+package server
+
+import (
+	"maps"
+	"portal/internal/models"
+	"slices"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// liveRoom is a room with members connected. Its lock guards the room and
+// is held for anything that reads or changes membership, roles, bans or
+// mutes, so busy rooms only hold each other up on the brief index lookups.
+//
+// A room is dropped from the index when its last member leaves and marked
+// closed, so a handler that looked it up just before that looks it up
+// again instead of joining a room nobody can find.
+type liveRoom struct {
+	mu     sync.Mutex
+	closed bool
+	*models.Room
+}
+
+// lockRoom returns the live room roomID with its lock held, or nil if
+// nobody is in it. Callers must not hold wss.mu.
+func (wss *WebSocketServer) lockRoom(roomID string) *liveRoom {
+	for {
+		wss.mu.RLock()
+		room := wss.rooms[roomID]
+		wss.mu.RUnlock()
+		if room == nil {
+			return nil
+		}
+
+		room.mu.Lock()
+		if !room.closed {
+			return room
+		}
+		room.mu.Unlock()
+	}
+}
+
+// lookupRoom returns the live room with its lock held if anyone is in it,
+// otherwise the persisted copy. Persisted rooms only become live once a
+// member joins. Callers must call unlock once done with the room.
+func (wss *WebSocketServer) lookupRoom(roomID string) (room *models.Room, unlock func(), err error) {
+	if live := wss.lockRoom(roomID); live != nil {
+		return live.Room, live.mu.Unlock, nil
+	}
+	room, err = wss.store.GetRoom(roomID)
+	return room, func() {}, err
+}
+
+// applyRoomSettings copies stored room settings onto the live room, if
+// anyone is in it. Settings older than the live ones are ignored, so
+// updates that finish out of order cannot roll each other back.
+func (wss *WebSocketServer) applyRoomSettings(stored *models.Room) {
+	room := wss.lockRoom(stored.ID)
+	if room == nil {
+		return
+	}
+	defer room.mu.Unlock()
+
+	if stored.UpdatedAt.Before(room.UpdatedAt) {
+		return
+	}
+	room.Name = stored.Name
+	room.IsPublic = stored.IsPublic
+	room.PasswordHash = stored.PasswordHash
+	room.UpdatedAt = stored.UpdatedAt
+}
+
+// activateRoom returns the live room for a persisted room with its lock
+// held, bringing it live if nobody is in it yet. A room brought live here
+// must get a member or be released with closeIfEmpty.
+func (wss *WebSocketServer) activateRoom(stored *models.Room) *liveRoom {
+	for {
+		wss.mu.Lock()
+		room, exists := wss.rooms[stored.ID]
+		if !exists {
+			// stored may be the Room of a live room that closed after the
+			// caller looked it up, so the new one gets maps of its own
+			fresh := *stored
+			fresh.Members = make(map[*websocket.Conn]string)
+			fresh.Moderators = maps.Clone(stored.Moderators)
+			fresh.Bans = maps.Clone(stored.Bans)
+			fresh.Muted = make(map[string]bool)
+			room = &liveRoom{Room: &fresh}
+			// Mutes last while anyone is in the room, on any instance
+			for userID := range wss.remote.muted(stored.ID) {
+				room.Muted[userID] = true
+			}
+			wss.rooms[stored.ID] = room
+		}
+		wss.mu.Unlock()
+
+		room.mu.Lock()
+		if !room.closed {
+			return room
+		}
+		room.mu.Unlock()
+	}
+}
+
+// lockRooms locks the live rooms among roomIDs in ID order, which is the
+// only way to hold more than one room lock without risking deadlock.
+func (wss *WebSocketServer) lockRooms(roomIDs []string) []*liveRoom {
+	sorted := append([]string(nil), roomIDs...)
+	slices.Sort(sorted)
+	sorted = slices.Compact(sorted)
+
+	rooms := make([]*liveRoom, 0, len(sorted))
+	for _, roomID := range sorted {
+		if room := wss.lockRoom(roomID); room != nil {
+			rooms = append(rooms, room)
+		}
+	}
+	return rooms
+}
+
+func unlockRooms(rooms []*liveRoom) {
+	for _, room := range rooms {
+		room.mu.Unlock()
+	}
+}
+
+// closeIfEmpty drops room from the index once nobody is left in it; the
+// store keeps it. Callers must hold room.mu.
+func (wss *WebSocketServer) closeIfEmpty(room *liveRoom) {
+	if len(room.Members) > 0 || room.closed {
+		return
+	}
+	room.closed = true
+
+	wss.mu.Lock()
+	if wss.rooms[room.ID] == room {
+		delete(wss.rooms, room.ID)
+	}
+	wss.mu.Unlock()
+}
+
+// clientFor returns the client that owns conn.
+func (wss *WebSocketServer) clientFor(conn *websocket.Conn) (*models.Client, bool) {
+	wss.mu.RLock()
+	defer wss.mu.RUnlock()
+	client, exists := wss.clients[conn]
+	return client, exists
+}
+
+// roomIDsOf returns a copy of the rooms client is in.
+func (wss *WebSocketServer) roomIDsOf(client *models.Client) []string {
+	wss.mu.RLock()
+	defer wss.mu.RUnlock()
+	return append([]string(nil), client.RoomIDs...)
+}
+
+// removeFromRoom drops client from room, telling the other members it left
+// when announce is set. Callers must hold room.mu and call closeIfEmpty
+// once done changing the room.
+func (wss *WebSocketServer) removeFromRoom(room *liveRoom, client *models.Client, announce bool) {
+	delete(room.Members, client.Conn)
+
+	wss.mu.Lock()
+	for i, id := range client.RoomIDs {
+		if id == room.ID {
+			client.RoomIDs = append(client.RoomIDs[:i], client.RoomIDs[i+1:]...)
+			break
+		}
+	}
+	leaving := models.MemberInfo{
+		UserID:   client.UserID,
+		Username: client.Username,
+		AvatarID: client.AvatarID,
+	}
+	wss.mu.Unlock()
+
+	if announce {
+		wss.broadcastToRoom(room, models.Message{
+			Type:    models.MessageUserLeft,
+			RoomID:  room.ID,
+			UserID:  client.UserID,
+			Payload: leaving,
+		})
+	}
+}
+
+// broadcastToRoom sends msg to every member of room, on every instance.
+// Callers must hold room.mu.
+func (wss *WebSocketServer) broadcastToRoom(room *liveRoom, msg models.Message) {
+	wss.broadcastExcept(room, nil, msg)
+}
+
+// broadcastExcept sends msg to every member of room on every instance, but
+// not to the connection except. Callers must hold room.mu.
+func (wss *WebSocketServer) broadcastExcept(room *liveRoom, except *websocket.Conn, msg models.Message) {
+	for conn := range room.Members {
+		if conn != except {
+			wss.sendTo(conn, msg)
+		}
+	}
+	wss.publish(clusterEvent{Kind: eventDeliver, RoomID: room.ID, Message: &msg})
+}
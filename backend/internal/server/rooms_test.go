@@ -0,0 +1,130 @@
+package server
+
+import (
+	"fmt"
+	"portal/internal/bus"
+	"portal/internal/models"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// checkLiveRoom checks what must hold of room while its lock is held: an
+// open room is the one indexed, and a closed one is neither indexed nor
+// has anyone left in it. Callers must hold room.mu.
+func checkLiveRoom(t *testing.T, wss *WebSocketServer, room *liveRoom) {
+	wss.mu.RLock()
+	indexed := wss.rooms[room.ID] == room
+	wss.mu.RUnlock()
+
+	if room.closed && (indexed || len(room.Members) > 0) {
+		t.Errorf("closed room %s is indexed %v with %d members", room.ID, indexed, len(room.Members))
+	}
+	if !room.closed && !indexed {
+		t.Errorf("open room %s is not indexed", room.ID)
+	}
+}
+
+// Members joining, leaving, signalling and dropping their connections all
+// at once must leave no one behind in a room once it closes.
+func TestRoomChurn(t *testing.T) {
+	store := newMemStore()
+	node := newTestNode(t, store, bus.NewLocal(), "node-a")
+	room := &models.Room{ID: "room0001", Name: "Busy", IsPublic: true, Creator: "user0",
+		Moderators: map[string]bool{}, Bans: map[string]bool{}}
+	if err := store.CreateRoom(room); err != nil {
+		t.Fatal(err)
+	}
+
+	// Look at every live room0001 while the members churn
+	var seenMu sync.Mutex
+	seen := make(map[*liveRoom]bool)
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			node.wss.mu.RLock()
+			room := node.wss.rooms["room0001"]
+			node.wss.mu.RUnlock()
+			if room == nil {
+				runtime.Gosched()
+				continue
+			}
+			seenMu.Lock()
+			seen[room] = true
+			seenMu.Unlock()
+
+			room.mu.Lock()
+			checkLiveRoom(t, node.wss, room)
+			room.mu.Unlock()
+		}
+	}()
+
+	// Goroutines rather than parallel subtests, which -parallel may run
+	// one at a time
+	const members, rounds = 6, 20
+	var wg sync.WaitGroup
+	for i := 0; i < members; i++ {
+		client := node.dial(t, fmt.Sprintf("user%d", i))
+		peerID := fmt.Sprintf("user%d", (i+1)%members)
+		dropOut := i%2 == 0
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for round := 0; round < rounds; round++ {
+				if msg := client.join("room0001", models.JoinRoomPayload{}); msg.Type != models.MessageRoomJoined {
+					t.Errorf("%s round %d join: %s %s", client.userID, round, msg.Type, msg.errorCode())
+					return
+				}
+				// The peer may be out of the room, so any reply will do
+				client.request(models.Message{Type: models.SignalOffer, RoomID: "room0001",
+					Payload: models.SignalingPayload{SDP: "v=0", ToUserID: peerID}})
+				if round == rounds-1 && dropOut {
+					// Drop the connection while still in the room
+					client.conn.Close()
+					return
+				}
+				if code := client.request(models.Message{Type: models.MessageLeaveRoom, RoomID: "room0001"}); code != "" {
+					t.Errorf("%s round %d leave: %q", client.userID, round, code)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Dropped connections are removed once the server notices them
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		node.wss.mu.RLock()
+		_, open := node.wss.rooms["room0001"]
+		node.wss.mu.RUnlock()
+		if !open {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("room0001 is still open after everyone left")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(stop)
+	<-stopped
+
+	if len(seen) == 0 {
+		t.Fatal("room0001 never opened")
+	}
+	for room := range seen {
+		room.mu.Lock()
+		if !room.closed {
+			t.Errorf("room %p is still open", room)
+		}
+		checkLiveRoom(t, node.wss, room)
+		room.mu.Unlock()
+	}
+}
@@ -1,9 +1,14 @@
 package server
 
 import (
+	"errors"
+	"log"
 	"net/http"
+	"portal/internal/auth"
+	"portal/internal/db"
 	"portal/internal/models"
 	"portal/internal/utils"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
@@ -17,15 +22,33 @@ func (s *Server) SetupRoutes() {
 		users := api.Group("/users")
 		{
 			users.POST("", s.CreateUser)
+			users.GET("/:id", s.requireAuth(), s.GetUser)
+			users.PATCH("/:id", s.requireAuth(), s.UpdateUser)
 		}
 
+		// TURN credentials
+		api.POST("/turn/credentials", s.requireAuth(), s.CreateTURNCredentials)
+
+		// Session routes
+		api.POST("/session", s.requireAuth(), s.RefreshSession)
+
+		// WebRTC configuration
+		api.GET("/ice", s.requireAuth(), s.GetICEServers)
+
+		// WebSocket protocol schema
+		api.GET("/schema", s.GetSchema)
+
 		// Room routes
-		rooms := api.Group("/rooms")
+		rooms := api.Group("/rooms", s.requireAuth())
 		{
 			rooms.GET("", s.GetRooms)
 			rooms.GET("/:id", s.GetRoom)
 			rooms.POST("", s.CreateRoom)
 			rooms.POST("/:id", s.UpdateRoom)
+			rooms.POST("/:id/join", s.CheckRoomJoin)
+			rooms.POST("/:id/invites", s.CreateInvite)
+			rooms.GET("/:id/invites", s.GetInvites)
+			rooms.DELETE("/:id/invites/:inviteId", s.DeleteInvite)
 		}
 	}
 
@@ -34,8 +57,17 @@ func (s *Server) SetupRoutes() {
 
 	// Health check
 	s.Router.GET("/health", func(c *gin.Context) {
+		// Lets load balancers stop routing here while clients drain
+		if s.ws.Draining() {
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"status":    "draining",
+				"websocket": s.ws.SendStats(),
+			})
+			return
+		}
 		c.JSON(http.StatusOK, gin.H{
-			"status": "ok",
+			"status":    "ok",
+			"websocket": s.ws.SendStats(),
 		})
 	})
 }
@@ -48,15 +80,22 @@ func (s *Server) GetRooms(c *gin.Context) {
 		Members int    `json:"members"`
 	}
 
-	rooms := make([]roomInfo, 0)
-	for _, room := range s.ws.rooms {
-		if room.IsPublic {
-			rooms = append(rooms, roomInfo{
-				ID:      room.ID,
-				Name:    room.Name,
-				Members: len(room.Members),
-			})
-		}
+	publicRooms, err := s.rooms.ListPublicRooms()
+	if err != nil {
+		log.Printf("error listing rooms: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to list rooms",
+		})
+		return
+	}
+
+	rooms := make([]roomInfo, 0, len(publicRooms))
+	for _, room := range publicRooms {
+		rooms = append(rooms, roomInfo{
+			ID:      room.ID,
+			Name:    room.Name,
+			Members: s.ws.memberCount(room.ID),
+		})
 	}
 
 	c.JSON(http.StatusOK, gin.H{
@@ -66,9 +105,9 @@ func (s *Server) GetRooms(c *gin.Context) {
 
 func (s *Server) GetRoom(c *gin.Context) {
 	roomID := c.Param("id")
-	room, exists := s.ws.rooms[roomID]
+	room, err := s.rooms.GetRoom(roomID)
 
-	if !exists {
+	if errors.Is(err, db.ErrRoomNotFound) {
 		c.JSON(http.StatusNotFound, gin.H{
 			"error":         "Room not found",
 			"createRoom":    true,
@@ -77,6 +116,13 @@ func (s *Server) GetRoom(c *gin.Context) {
 		})
 		return
 	}
+	if err != nil {
+		log.Printf("error loading room %s: %v", roomID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to load room",
+		})
+		return
+	}
 
 	if !room.IsPublic {
 		c.JSON(http.StatusForbidden, gin.H{
@@ -89,7 +135,7 @@ func (s *Server) GetRoom(c *gin.Context) {
 		"id":      room.ID,
 		"name":    room.Name,
 		"creator": room.Creator,
-		"members": len(room.Members),
+		"members": s.ws.memberCount(room.ID),
 	})
 }
 
@@ -97,8 +143,8 @@ func (s *Server) CreateRoom(c *gin.Context) {
 	type createRoomRequest struct {
 		IsPublic bool   `json:"isPublic"`
 		Password string `json:"password,omitempty"`
-		UserID   string `json:"userId" binding:"required"`
-		Name     string `json:"name,omitempty"` // Optional, will generate if not provided
+		UserID   string `json:"userId,omitempty"` // Optional, must match the session if sent
+		Name     string `json:"name,omitempty"`   // Optional, will generate if not provided
 	}
 
 	var req createRoomRequest
@@ -109,30 +155,53 @@ func (s *Server) CreateRoom(c *gin.Context) {
 		return
 	}
 
+	userID := currentUserID(c)
+	if req.UserID != "" && req.UserID != userID {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "UserID does not match session",
+		})
+		return
+	}
+
 	roomName := req.Name
 	if roomName == "" {
 		roomName = utils.GenerateRoomName()
 	}
 
-	roomID := utils.GenerateShortID()
+	passwordHash, ok := s.hashRoomPassword(c, req.Password)
+	if !ok {
+		return
+	}
+
 	room := &models.Room{
-		ID:       roomID,
-		Name:     roomName,
-		Creator:  req.UserID,
-		IsPublic: req.IsPublic,
-		Password: req.Password,
-		Members:  make(map[*websocket.Conn]string),
+		Name:         roomName,
+		Creator:      userID,
+		IsPublic:     req.IsPublic,
+		PasswordHash: passwordHash,
+		Members:      make(map[*websocket.Conn]string),
 	}
 
-	s.ws.mu.Lock()
-	s.ws.rooms[roomID] = room
-	s.ws.mu.Unlock()
+	// Generated IDs can collide with persisted rooms, so retry a few times
+	var err error
+	for attempt := 0; attempt < 5; attempt++ {
+		room.ID = utils.GenerateShortID()
+		if err = s.rooms.CreateRoom(room); !errors.Is(err, db.ErrRoomExists) {
+			break
+		}
+	}
+	if err != nil {
+		log.Printf("error creating room: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to create room",
+		})
+		return
+	}
 
 	c.JSON(http.StatusCreated, gin.H{
-		"roomId":   roomID,
+		"roomId":   room.ID,
 		"name":     roomName,
 		"isPublic": req.IsPublic,
-		"creator":  req.UserID,
+		"creator":  userID,
 	})
 }
 
@@ -140,7 +209,7 @@ func (s *Server) UpdateRoom(c *gin.Context) {
 	roomID := c.Param("id")
 
 	type updateRoomRequest struct {
-		UserID   string `json:"userId" binding:"required"`
+		UserID   string `json:"userId,omitempty"` // Optional, must match the session if sent
 		Name     string `json:"name,omitempty"`
 		IsPublic *bool  `json:"isPublic,omitempty"`
 		Password string `json:"password,omitempty"`
@@ -154,11 +223,33 @@ func (s *Server) UpdateRoom(c *gin.Context) {
 		return
 	}
 
-	s.ws.mu.Lock()
-	defer s.ws.mu.Unlock()
+	userID := currentUserID(c)
+	if req.UserID != "" && req.UserID != userID {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "UserID does not match session",
+		})
+		return
+	}
 
-	room, exists := s.ws.rooms[roomID]
-	if !exists {
+	// bcrypt and the database write are too slow to run while holding the
+	// room lock, which is only taken to read the room and later to swap in
+	// the new settings
+	var passwordHash string
+	if req.Password != "" {
+		hash, ok := s.hashRoomPassword(c, req.Password)
+		if !ok {
+			return
+		}
+		passwordHash = hash
+	}
+
+	var updated models.Room
+	room, unlock, err := s.ws.lookupRoom(roomID)
+	if err == nil {
+		updated = *room
+	}
+	unlock()
+	if errors.Is(err, db.ErrRoomNotFound) {
 		// Room doesn't exist, ask for creation details
 		c.JSON(http.StatusNotFound, gin.H{
 			"error":         "Room not found",
@@ -168,30 +259,136 @@ func (s *Server) UpdateRoom(c *gin.Context) {
 		})
 		return
 	}
+	if err != nil {
+		log.Printf("error loading room %s: %v", roomID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to load room",
+		})
+		return
+	}
 
 	// Check if the user is the creator
-	if room.Creator != req.UserID {
+	if updated.Creator != userID {
 		c.JSON(http.StatusForbidden, gin.H{
 			"error": "Only the room creator can update the room",
 		})
 		return
 	}
 
-	// Update room properties
+	// Update room properties on a copy so a failed write leaves the live room untouched
 	if req.Name != "" {
-		room.Name = req.Name
+		updated.Name = req.Name
 	}
 	if req.IsPublic != nil {
-		room.IsPublic = *req.IsPublic
+		updated.IsPublic = *req.IsPublic
 	}
-	if req.Password != "" {
-		room.Password = req.Password
+	if passwordHash != "" {
+		updated.PasswordHash = passwordHash
+	}
+
+	if err := s.rooms.UpdateRoom(&updated); err != nil {
+		log.Printf("error updating room %s: %v", roomID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to update room",
+		})
+		return
+	}
+	s.ws.applyRoomSettings(&updated)
+	s.ws.publishRoomChanged(updated.ID)
+
+	c.JSON(http.StatusOK, gin.H{
+		"roomId":   updated.ID,
+		"name":     updated.Name,
+		"isPublic": updated.IsPublic,
+		"creator":  updated.Creator,
+	})
+}
+
+// CheckRoomJoin lets clients verify a room password before opening a
+// WebSocket. It shares the lockout with join_room.
+func (s *Server) CheckRoomJoin(c *gin.Context) {
+	roomID := c.Param("id")
+
+	type checkJoinRequest struct {
+		Password string `json:"password"`
+	}
+
+	var req checkJoinRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+		})
+		return
+	}
+
+	room, err := s.rooms.GetRoom(roomID)
+	if errors.Is(err, db.ErrRoomNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error":         "Room not found",
+			"createRoom":    true,
+			"suggestedName": utils.GenerateRoomName(),
+			"roomId":        roomID,
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("error loading room %s: %v", roomID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to load room",
+		})
+		return
+	}
+
+	if room.Bans[currentUserID(c)] {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "You are banned from this room",
+		})
+		return
+	}
+
+	if !room.IsPublic {
+		switch check, wait := s.ws.checkJoinPassword(room.ID, room.Creator, room.PasswordHash, currentUserID(c), c.ClientIP(), req.Password); check {
+		case joinLockedOut:
+			retryAfter := lockoutSeconds(wait)
+			lockout := newLockoutError(retryAfter)
+			c.Header("Retry-After", strconv.Itoa(retryAfter))
+			c.JSON(http.StatusTooManyRequests, gin.H{
+				"error":      lockout.Message,
+				"code":       lockout.Code,
+				"retryAfter": retryAfter,
+			})
+			return
+		case joinBadPassword:
+			c.JSON(http.StatusForbidden, gin.H{
+				"error": "Invalid password",
+			})
+			return
+		}
 	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"roomId":   room.ID,
 		"name":     room.Name,
 		"isPublic": room.IsPublic,
-		"creator":  room.Creator,
 	})
 }
+
+// hashRoomPassword hashes a room password, writing the error response
+// itself if that fails.
+func (s *Server) hashRoomPassword(c *gin.Context, password string) (string, bool) {
+	hash, err := auth.HashPassword(password, s.config.PasswordCost)
+	if errors.Is(err, auth.ErrPasswordTooLong) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Password too long",
+		})
+		return "", false
+	}
+	if err != nil {
+		log.Printf("error hashing room password: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to hash password",
+		})
+		return "", false
+	}
+	return hash, true
+}
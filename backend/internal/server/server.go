@@ -1,41 +1,114 @@
 package server
 
 import (
+	"context"
+	"errors"
+	"log"
 	"net/http"
+	"portal/internal/auth"
+	"portal/internal/bus"
+	"portal/internal/codec"
 	"portal/internal/config"
 	"portal/internal/db"
+	"portal/internal/models"
+	"portal/internal/utils"
+	"strconv"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 type Server struct {
 	config   *config.Config
 	Router   *gin.Engine
+	http     *http.Server
+	metrics  *http.Server // Nil when METRICS_ADDRESS is empty
 	ws       *WebSocketServer
 	db       *db.Database
+	rooms    db.RoomStore
+	users    db.UserStore
+	invites  db.InviteStore
+	keys     *auth.Keyring
 	upgrader websocket.Upgrader
+
+	// Served at /metrics on the metrics listener
+	registry        *prometheus.Registry
+	requestDuration *prometheus.HistogramVec
 }
 
-func NewServer(cfg *config.Config, database *db.Database) *Server {
+func NewServer(cfg *config.Config, database *db.Database, events bus.Bus) (*Server, error) {
+	rooms := db.NewPostgresRoomStore(database)
+	users := db.NewPostgresUserStore(database)
+	invites := db.NewPostgresInviteStore(database)
+
+	var keys *auth.Keyring
+	var err error
+	if cfg.SessionKeys != "" {
+		keys, err = auth.NewKeyring(cfg.SessionKeys)
+	} else {
+		log.Printf("SESSION_KEYS is not set, sessions will not survive a restart")
+		keys, err = auth.NewRandomKeyring()
+	}
+	if err != nil {
+		return nil, err
+	}
+
 	server := &Server{
-		config: cfg,
-		Router: gin.Default(),
-		ws:     NewWebSocketServer(),
-		db:     database,
+		config:          cfg,
+		Router:          gin.Default(),
+		ws:              NewWebSocketServer(cfg, keys, rooms, users, invites, events),
+		db:              database,
+		rooms:           rooms,
+		users:           users,
+		invites:         invites,
+		keys:            keys,
+		registry:        prometheus.NewRegistry(),
+		requestDuration: newRequestDuration(),
 		upgrader: websocket.Upgrader{
+			Subprotocols: codec.Subprotocols(),
 			CheckOrigin: func(r *http.Request) bool {
 				return true
 			},
 		},
 	}
 
+	server.http = &http.Server{
+		Addr:    cfg.ServerAddress,
+		Handler: server.Router,
+	}
+
+	// Metrics stay off the public listener, which anyone can reach
+	if cfg.MetricsAddress != "" {
+		mux := http.NewServeMux()
+		mux.Handle("GET /metrics", promhttp.HandlerFor(server.registry, promhttp.HandlerOpts{}))
+		server.metrics = &http.Server{
+			Addr:    cfg.MetricsAddress,
+			Handler: mux,
+		}
+	}
+
+	server.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		database.StatsCollector(),
+		server.ws,
+		server.requestDuration,
+	)
+	server.Router.Use(server.observeRequests)
+
+	if err := server.Router.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		return nil, err
+	}
+
 	// Configure CORS
 	server.Router.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"http://localhost:5173"},
 		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Accept"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "Authorization"},
 		AllowCredentials: true,
 	}))
 
@@ -48,11 +121,11 @@ func NewServer(cfg *config.Config, database *db.Database) *Server {
 	})
 
 	server.SetupRoutes()
-	return server
+	return server, nil
 }
 
 func (s *Server) CreateUser(c *gin.Context) {
-	userID, err := s.db.CreateUser()
+	userID, err := s.users.CreateUser()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": "Failed to create user",
@@ -60,12 +133,123 @@ func (s *Server) CreateUser(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusCreated, gin.H{
-		"userId": userID,
-	})
+	s.issueSession(c, http.StatusCreated, userID)
+}
+
+func (s *Server) GetUser(c *gin.Context) {
+	user, err := s.users.GetUser(c.Param("id"))
+	if errors.Is(err, db.ErrUserNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "User not found",
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("error loading user %s: %v", c.Param("id"), err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to load user",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, userResponse(user))
+}
+
+func (s *Server) UpdateUser(c *gin.Context) {
+	if c.Param("id") != currentUserID(c) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "You can only update your own profile",
+		})
+		return
+	}
+
+	type updateUserRequest struct {
+		Username *string `json:"username,omitempty"`
+		AvatarID *string `json:"avatarId,omitempty"`
+	}
+
+	var req updateUserRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+		})
+		return
+	}
+
+	if req.Username != nil && !utils.ValidateUsername(*req.Username) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid username",
+		})
+		return
+	}
+	if req.AvatarID != nil && !utils.ValidateAvatarID(*req.AvatarID) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid avatar ID",
+		})
+		return
+	}
+
+	user, err := s.users.GetUser(c.Param("id"))
+	if errors.Is(err, db.ErrUserNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "User not found",
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("error loading user %s: %v", c.Param("id"), err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to load user",
+		})
+		return
+	}
+
+	if req.Username != nil {
+		user.Username = *req.Username
+	}
+	if req.AvatarID != nil {
+		user.AvatarID = *req.AvatarID
+	}
+
+	if err := s.users.UpdateUser(user); err != nil {
+		log.Printf("error updating user %s: %v", user.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to update user",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, userResponse(user))
+}
+
+func userResponse(user *models.User) gin.H {
+	return gin.H{
+		"userId":     user.ID,
+		"username":   user.Username,
+		"avatarId":   user.AvatarID,
+		"createdAt":  user.CreatedAt,
+		"lastSeenAt": user.LastSeenAt,
+	}
 }
 
 func (s *Server) handleWebSocket(c *gin.Context) {
+	claims, err := s.keys.Verify(websocketToken(c), auth.PurposeSession)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "Invalid or expired session",
+		})
+		return
+	}
+
+	if s.ws.Draining() {
+		retryAfter := max(int(s.config.ShutdownReconnectAfter.Seconds()), 1)
+		c.Header("Retry-After", strconv.Itoa(retryAfter))
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error": "Server is shutting down",
+		})
+		return
+	}
+
 	conn, err := s.upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
@@ -74,9 +258,42 @@ func (s *Server) handleWebSocket(c *gin.Context) {
 		return
 	}
 
-	s.ws.HandleConnection(conn)
+	s.ws.HandleConnection(conn, claims.Subject, c.ClientIP())
 }
 
+// Start serves HTTP until Shutdown is called.
 func (s *Server) Start() error {
-	return s.Router.Run(s.config.ServerAddress)
+	servers := []*http.Server{s.http}
+	if s.metrics != nil {
+		servers = append(servers, s.metrics)
+	}
+
+	errs := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func() {
+			errs <- srv.ListenAndServe()
+		}()
+	}
+	for range servers {
+		if err := <-errs; !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Shutdown drains WebSocket clients, then stops the HTTP servers once
+// in-flight requests finish, giving up when ctx is done. Metrics are served
+// until the drain is over.
+func (s *Server) Shutdown(ctx context.Context) error {
+	wsErr := s.ws.Shutdown(ctx)
+	if err := s.http.Shutdown(ctx); err != nil {
+		return err
+	}
+	if s.metrics != nil {
+		if err := s.metrics.Shutdown(ctx); err != nil {
+			return err
+		}
+	}
+	return wsErr
 }
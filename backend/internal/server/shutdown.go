@@ -0,0 +1,83 @@
+package server
+
+import (
+	"context"
+	"log"
+	"math/rand/v2"
+	"portal/internal/models"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Draining reports whether the server is shutting down and turning away
+// new connections.
+func (wss *WebSocketServer) Draining() bool {
+	wss.mu.RLock()
+	defer wss.mu.RUnlock()
+	return wss.draining
+}
+
+// Shutdown stops accepting connections, tells every client to reconnect
+// shortly and closes them, then waits for their connections to finish
+// until ctx is done. Connections still open then are closed outright.
+func (wss *WebSocketServer) Shutdown(ctx context.Context) error {
+	// The other instances drop this one's members now, so clients that
+	// reconnect to them are not listed twice
+	wss.stopCluster()
+
+	wss.mu.Lock()
+	wss.draining = true
+	clients := make([]*models.Client, 0, len(wss.clients))
+	for _, client := range wss.clients {
+		clients = append(clients, client)
+	}
+	wss.mu.Unlock()
+
+	for _, client := range clients {
+		wss.sendShutdown(client)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wss.conns.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	open := 0
+	for _, client := range clients {
+		select {
+		case <-client.Outbox.Done():
+		default:
+			open++
+		}
+		client.Conn.Close()
+	}
+	log.Printf("closed %d WebSocket connections that did not drain in time", open)
+	return ctx.Err()
+}
+
+// sendShutdown tells client the server is going away and when to come
+// back, then closes its connection with 1012 (service restart). Each
+// client waits somewhere between ShutdownReconnectAfter and twice that,
+// so they do not all reconnect at once.
+func (wss *WebSocketServer) sendShutdown(client *models.Client) {
+	reconnectAfter := wss.config.ShutdownReconnectAfter
+	if reconnectAfter > 0 {
+		reconnectAfter += rand.N(reconnectAfter)
+	}
+
+	client.Outbox.Send(models.Message{
+		Type: models.MessageServerShutdown,
+		Payload: models.ServerShutdownPayload{
+			ReconnectAfter: int(reconnectAfter / time.Millisecond),
+		},
+	})
+	client.Outbox.Close(websocket.CloseServiceRestart, "server restarting")
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"portal/internal/auth"
+	"portal/internal/bus"
+	"portal/internal/models"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// expectShutdown reads until server_shutdown, checks the reconnect hint is
+// within ShutdownReconnectAfter and twice that, and then expects the
+// connection to close with 1012.
+func (c *testClient) expectShutdown(reconnectAfter time.Duration) {
+	c.t.Helper()
+	var payload models.ServerShutdownPayload
+	if err := json.Unmarshal(c.expect(models.MessageServerShutdown).Payload, &payload); err != nil {
+		c.t.Fatal(err)
+	}
+	hint := time.Duration(payload.ReconnectAfter) * time.Millisecond
+	if hint < reconnectAfter || hint >= 2*reconnectAfter {
+		c.t.Errorf("%s told to reconnect after %v, want %v to %v", c.userID, hint, reconnectAfter, 2*reconnectAfter)
+	}
+
+	if code, _ := c.expectClose(); code != websocket.CloseServiceRestart {
+		c.t.Errorf("%s closed with %d, want %d", c.userID, code, websocket.CloseServiceRestart)
+	}
+}
+
+func TestShutdownDrainsClients(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := newMemStore()
+	node := newTestNode(t, store, bus.NewLocal(), "node-a")
+	room := &models.Room{ID: "room0001", Name: "Draining", IsPublic: true, Creator: "alice",
+		Moderators: map[string]bool{}, Bans: map[string]bool{}}
+	if err := store.CreateRoom(room); err != nil {
+		t.Fatal(err)
+	}
+
+	// The public routes, in front of the same WebSocket server
+	s := &Server{config: node.wss.config, Router: gin.New(), ws: node.wss, keys: node.keys,
+		rooms: store, users: store, invites: store}
+	s.SetupRoutes()
+	public := httptest.NewServer(s.Router)
+	t.Cleanup(public.Close)
+
+	health := func() int {
+		t.Helper()
+		resp, err := http.Get(public.URL + "/health")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := health(); status != http.StatusOK {
+		t.Fatalf("/health before shutdown = %d", status)
+	}
+
+	alice := node.dial(t, "alice")
+	if msg := alice.join("room0001", models.JoinRoomPayload{}); msg.Type != models.MessageRoomJoined {
+		t.Fatalf("alice join: %s %s", msg.Type, msg.errorCode())
+	}
+	bob := node.dial(t, "bob")
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdown <- node.wss.Shutdown(ctx)
+	}()
+
+	reconnectAfter := node.wss.config.ShutdownReconnectAfter
+	alice.expectShutdown(reconnectAfter)
+
+	// Draining began before anyone was told, and lasts until the process exits
+	if status := health(); status != http.StatusServiceUnavailable {
+		t.Errorf("/health while draining = %d, want %d", status, http.StatusServiceUnavailable)
+	}
+	token, err := node.keys.Sign(auth.Claims{Subject: "carol", Purpose: auth.PurposeSession,
+		ExpiresAt: time.Now().Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := http.Header{"Authorization": {"Bearer " + token}}
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(public.URL, "http")+"/ws", header)
+	if err == nil {
+		t.Error("new connection accepted while draining")
+	} else if resp == nil || resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("new connection while draining: %v", err)
+	}
+
+	// One upgraded just as shutdown began is sent away too
+	node.dial(t, "dave").expectShutdown(reconnectAfter)
+
+	bob.expectShutdown(reconnectAfter)
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown() = %v, want every client drained", err)
+	}
+}
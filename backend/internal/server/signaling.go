@@ -0,0 +1,122 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"portal/internal/models"
+	"sync"
+)
+
+const (
+	// maxMessageSize bounds any single frame read from a client.
+	maxMessageSize = 128 * 1024
+	// maxSDPLength bounds the SDP of an offer or answer. It is enforced
+	// by the validate tag on SignalingPayload.SDP.
+	maxSDPLength = 64 * 1024
+	// maxCandidateLength bounds the candidate string, enforced by the
+	// validate tag on ICECandidate.Candidate.
+	maxCandidateLength = 4 * 1024
+)
+
+var legacySignalWarning sync.Once
+
+var signalKinds = map[string]string{
+	models.SignalOffer:     "offer",
+	models.SignalAnswer:    "answer",
+	models.SignalCandidate: "candidate",
+}
+
+// handleTypedSignal validates a signal_offer, signal_answer or
+// signal_candidate and forwards it with the sender stamped by the server.
+func (wss *WebSocketServer) handleTypedSignal(client *models.Client, msg models.Message, payload *models.SignalingPayload) {
+	// An empty toUserId is an error rather than a broadcast, so check
+	// whether it was sent at all
+	raw, _ := msg.Payload.(map[string]interface{})
+	_, targeted := raw["toUserId"]
+
+	payload.Type = signalKinds[msg.Type]
+	if err := validateSignal(payload); err != nil {
+		wss.signalDropped(client, msg, models.ErrCodeInvalidSignal, err.Error())
+		return
+	}
+	payload.FromUserID = client.UserID
+
+	wss.forwardSignal(client, msg, models.Message{
+		Type:    msg.Type,
+		RoomID:  msg.RoomID,
+		UserID:  client.UserID,
+		Payload: *payload,
+	}, payload.ToUserID, targeted)
+}
+
+func validateSignal(payload *models.SignalingPayload) error {
+	switch payload.Type {
+	case "offer", "answer":
+		if payload.SDP == "" {
+			return fmt.Errorf("%s requires an SDP", payload.Type)
+		}
+		payload.Candidate = nil
+
+	case "candidate":
+		if payload.Candidate == nil {
+			return errors.New("candidate must be an object")
+		}
+		payload.SDP = ""
+	}
+	return nil
+}
+
+// forwardSignal delivers a signal from client to toUserID, or to every
+// other member when the client left the target out entirely, and acks req.
+func (wss *WebSocketServer) forwardSignal(client *models.Client, req models.Message, forward models.Message, toUserID string, targeted bool) {
+	roomID := forward.RoomID
+
+	room := wss.lockRoom(roomID)
+	if room == nil || !wss.inRoom(client, roomID) {
+		if room != nil {
+			room.mu.Unlock()
+		}
+		wss.signalDropped(client, req, models.ErrCodeNotInRoom, "You are not in this room")
+		return
+	}
+	defer room.mu.Unlock()
+
+	if room.Muted[client.UserID] {
+		wss.signalDropped(client, req, models.ErrCodeMuted, "You are muted in this room")
+		return
+	}
+
+	if !targeted {
+		wss.broadcastExcept(room, client.Conn, forward)
+		wss.metrics.signalsForwarded.Inc()
+		sendAck(client, req)
+		return
+	}
+
+	targets := wss.memberConns(room, toUserID)
+	remote := wss.remote.has(roomID, toUserID)
+	if len(targets) == 0 && !remote {
+		wss.signalDropped(client, req, models.ErrCodeTargetNotInRoom, "Target user is not in this room")
+		return
+	}
+	for _, conn := range targets {
+		if conn != client.Conn {
+			wss.sendTo(conn, forward)
+		}
+	}
+	if remote {
+		wss.publish(clusterEvent{Kind: eventDeliver, RoomID: roomID, UserID: toUserID, Message: &forward})
+	}
+	wss.metrics.signalsForwarded.Inc()
+	sendAck(client, req)
+}
+
+// decodePayload converts a generically decoded payload into a typed struct.
+func decodePayload(payload interface{}, v interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
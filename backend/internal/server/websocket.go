@@ -1,33 +1,81 @@
 package server
 
 import (
-	"encoding/json"
+	"errors"
 	"log"
+	"portal/internal/auth"
+	"portal/internal/bus"
+	"portal/internal/codec"
+	"portal/internal/config"
+	"portal/internal/db"
 	"portal/internal/models"
 	"portal/internal/utils"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
 
 type WebSocketServer struct {
-	clients    map[*websocket.Conn]*models.Client
-	rooms      map[string]*models.Room
-	register   chan *websocket.Conn
-	unregister chan *websocket.Conn
-	broadcast  chan []byte
-	mu         sync.RWMutex
+	clients  map[*websocket.Conn]*models.Client
+	rooms    map[string]*liveRoom
+	config   *config.Config
+	keys     *auth.Keyring
+	store    db.RoomStore
+	users    db.UserStore
+	invites  db.InviteStore
+	lockouts *lockoutTracker
+
+	// mu guards the clients, rooms and sessions indexes, draining and each
+	// client's Username, AvatarID, RoomIDs and Presence. It is only held briefly.
+	// Room state is guarded by the room's own lock, which is taken before
+	// mu when both are needed.
+	mu       sync.RWMutex
+	draining bool
+	// Connections being served, so shutdown can wait for them
+	conns sync.WaitGroup
+
+	// Sessions that can be resumed, by resume token, guarded by mu
+	sessions map[string]*models.Client
+	// Clients waiting to be resumed. resumeMu may be taken while holding
+	// mu, but not the other way round.
+	detached map[*models.Client]*detachedSession
+	resumeMu sync.Mutex
+
+	sendCounters sendCounters
+	metrics      *wsMetrics
+
+	// Room events go out on bus to the other instances, and remote tracks
+	// the members connected to them
+	bus            bus.Bus
+	remote         *remoteRoster
+	clusterDone    chan struct{}
+	clusterStopped atomic.Bool
 }
 
-func NewWebSocketServer() *WebSocketServer {
-	return &WebSocketServer{
-		clients:    make(map[*websocket.Conn]*models.Client),
-		rooms:      make(map[string]*models.Room),
-		register:   make(chan *websocket.Conn),
-		unregister: make(chan *websocket.Conn),
-		broadcast:  make(chan []byte),
+func NewWebSocketServer(cfg *config.Config, keys *auth.Keyring, store db.RoomStore, users db.UserStore, invites db.InviteStore, events bus.Bus) *WebSocketServer {
+	wss := &WebSocketServer{
+		config:   cfg,
+		keys:     keys,
+		clients:  make(map[*websocket.Conn]*models.Client),
+		rooms:    make(map[string]*liveRoom),
+		store:    store,
+		users:    users,
+		invites:  invites,
+		lockouts: newLockoutTracker(cfg.JoinLockoutBaseDelay, cfg.JoinLockoutMaxDelay),
+		sessions: make(map[string]*models.Client),
+		detached: make(map[*models.Client]*detachedSession),
+		metrics:  newWSMetrics(),
+
+		bus:         events,
+		remote:      newRemoteRoster(),
+		clusterDone: make(chan struct{}),
 	}
+	wss.startCluster()
+	return wss
 }
 
 // generateRoomID creates a unique room identifier using UUID
@@ -35,403 +83,542 @@ func generateRoomID() string {
 	return uuid.New().String()
 }
 
-func (wss *WebSocketServer) HandleConnection(conn *websocket.Conn) {
+// HandleConnection serves an upgraded connection for an authenticated user.
+func (wss *WebSocketServer) HandleConnection(conn *websocket.Conn, userID, ip string) {
 	client := &models.Client{
-		Conn:    conn,
-		RoomIDs: make([]string, 0),
+		Conn:            conn,
+		IP:              ip,
+		UserID:          userID,
+		RoomIDs:         make([]string, 0),
+		ProtocolVersion: models.MinProtocolVersion,
+		Capabilities:    make(map[string]bool),
+		Codec:           codec.ForSubprotocol(conn.Subprotocol()),
+		Presence:        models.PresenceOnline,
+		ConnectedAt:     time.Now(),
 	}
+	outbox := wss.startOutbox(client)
 
 	wss.mu.Lock()
-	// Check for existing connection with same userID
-	for existingConn, existingClient := range wss.clients {
-		if existingClient.UserID == client.UserID {
-			// Close existing connection
-			existingConn.Close()
-			// Remove from all rooms
-			wss.removeClientFromAllRooms(existingClient)
-			delete(wss.clients, existingConn)
-			break
-		}
+	if wss.draining {
+		// Upgraded just as shutdown began
+		wss.mu.Unlock()
+		wss.sendShutdown(client)
+		<-outbox.Done()
+		return
+	}
+	// Counted under the lock once draining is ruled out, since Shutdown
+	// may already be waiting and a WaitGroup must not grow from zero then
+	wss.conns.Add(1)
+	defer wss.conns.Done()
+	replaced, admitted := wss.admitSession(client)
+	if admitted {
+		wss.clients[conn] = client
 	}
-	wss.clients[conn] = client
 	wss.mu.Unlock()
 
+	if !admitted {
+		rejectSession(client)
+		<-outbox.Done()
+		return
+	}
+	wss.sessionStarted(client)
+	for _, old := range replaced {
+		wss.replaceSession(old)
+	}
+
 	defer func() {
-		wss.mu.Lock()
-		// Remove client from all rooms and notify others
-		wss.removeClientFromAllRooms(client)
-		delete(wss.clients, conn)
-		wss.mu.Unlock()
+		// Nothing to do if another connection resumed this session
+		wss.mu.RLock()
+		current := wss.clients[conn] == client
+		wss.mu.RUnlock()
+		if current {
+			wss.detach(client)
+		}
+		outbox.stop()
 		conn.Close()
+		wss.publish(clusterEvent{Kind: eventSessionEnded, UserID: client.UserID})
+
+		if client.UserID != "" {
+			wss.touchUser(client.UserID)
+		}
 	}()
 
-	for {
-		_, message, err := conn.ReadMessage()
+	conn.SetReadLimit(maxMessageSize)
+
+	var seen activity
+	seen.touch()
+	done := make(chan struct{})
+	defer close(done)
+	wss.startHeartbeat(client, &seen, done)
+
+	for first := true; ; first = false {
+		frameType, message, err := conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("error: %v", err)
 			}
 			break
 		}
+		wss.markActive(client, &seen)
+
+		// Text frames are always JSON so a binary client can still be
+		// debugged by hand
+		decoder := codec.JSON
+		if frameType == websocket.BinaryMessage {
+			decoder = client.Codec
+		}
 
 		var msg models.Message
-		if err := json.Unmarshal(message, &msg); err != nil {
-			log.Printf("error unmarshaling message: %v", err)
+		if err := decoder.Unmarshal(message, &msg); err != nil {
+			wss.metrics.messages.WithLabelValues("undecodable").Inc()
+			sendError(client, models.Message{}, models.ErrCodeInvalidMessage, "Message could not be decoded")
+			continue
+		}
+
+		wss.countMessage(msg.Type)
+
+		// Identity comes from the session; a userId in the message may only restate it
+		if msg.UserID != "" && msg.UserID != client.UserID {
+			sendError(client, msg, models.ErrCodeIdentityMismatch, "UserID does not match session")
+			continue
+		}
+
+		payload, err := decodeClientPayload(msg)
+		if err != nil {
+			sendPayloadError(client, msg, err)
 			continue
 		}
 
 		switch msg.Type {
-		case "join_room":
-			wss.handleJoinRoom(client, msg)
-		case "create_room":
-			wss.handleCreateRoom(client, msg)
-		case "leave_room":
+		case models.MessageHello:
+			if !first {
+				sendError(client, msg, models.ErrCodeInvalidMessage, "hello must be the first message")
+				continue
+			}
+			if !wss.handleHello(client, msg, payload.(*models.HelloPayload)) {
+				return
+			}
+		case models.MessageResume:
+			wss.handleResume(client, msg, payload.(*models.ResumePayload))
+		case models.MessageSetPresence:
+			wss.handleSetPresence(client, msg, payload.(*models.SetPresencePayload))
+		case models.MessageJoinRoom:
+			wss.handleJoinRoom(client, msg, payload.(*models.JoinRoomPayload))
+		case models.MessageCreateRoom:
+			wss.handleCreateRoom(client, msg, payload.(*models.CreateRoomPayload))
+		case models.MessageLeaveRoom:
 			wss.handleLeaveRoom(client, msg)
-		case "signal":
-			wss.handleSignal(client, msg)
+		case models.MessageSignal:
+			wss.handleSignal(client, msg, payload.(*models.LegacySignalPayload))
+		case models.SignalOffer, models.SignalAnswer, models.SignalCandidate:
+			wss.handleTypedSignal(client, msg, payload.(*models.SignalingPayload))
+		case models.MessageKickMember:
+			wss.handleKickMember(client, msg, payload.(*models.MemberPayload))
+		case models.MessageBanMember:
+			wss.handleBanMember(client, msg, payload.(*models.MemberPayload))
+		case models.MessageUnbanMember:
+			wss.handleUnbanMember(client, msg, payload.(*models.MemberPayload))
+		case models.MessagePromoteMember:
+			wss.handlePromoteMember(client, msg, payload.(*models.PromoteMemberPayload))
+		case models.MessageMuteMember:
+			wss.handleMuteMember(client, msg, payload.(*models.MuteMemberPayload))
 		}
 	}
 }
 
 func (wss *WebSocketServer) RoomExists(roomID string) bool {
-	wss.mu.RLock()
-	defer wss.mu.RUnlock()
-	_, exists := wss.rooms[roomID]
-	return exists
+	_, unlock, err := wss.lookupRoom(roomID)
+	unlock()
+	return err == nil
 }
 
-func (wss *WebSocketServer) handleJoinRoom(client *models.Client, msg models.Message) {
+// memberCount returns how many connections are currently in a room, on
+// every instance.
+func (wss *WebSocketServer) memberCount(roomID string) int {
+	remote := wss.remote.count(roomID)
+	room := wss.lockRoom(roomID)
+	if room == nil {
+		return remote
+	}
+	defer room.mu.Unlock()
+	return len(room.Members) + remote
+}
+
+func (wss *WebSocketServer) handleJoinRoom(client *models.Client, msg models.Message, payload *models.JoinRoomPayload) {
 	roomID := msg.RoomID
 
 	if !utils.ValidateRoomID(roomID) {
-		client.Conn.WriteJSON(models.Message{
-			Type:    "error",
-			Payload: "Invalid room ID format",
-		})
+		wss.joinFailed(client, msg, models.ErrCodeInvalidRoomID, "Invalid room ID format")
 		return
 	}
 
-	if msg.UserID == "" {
-		client.Conn.WriteJSON(models.Message{
-			Type:    "error",
-			Payload: "UserID is required",
-		})
-		return
-	}
+	username, avatarID := payload.Username, payload.AvatarID
 
-	type joinPayload struct {
-		Password string `json:"password,omitempty"`
-		Username string `json:"username"`
-		AvatarID string `json:"avatarId"`
+	// Fall back to the stored profile for anything the payload omits
+	if username == "" || avatarID == "" {
+		profile, err := wss.users.GetUser(client.UserID)
+		if err != nil && !errors.Is(err, db.ErrUserNotFound) {
+			log.Printf("error loading profile for %s: %v", client.UserID, err)
+		}
+		if profile != nil {
+			if username == "" {
+				username = profile.Username
+			}
+			if avatarID == "" {
+				avatarID = profile.AvatarID
+			}
+		}
 	}
 
-	payload, ok := msg.Payload.(map[string]interface{})
-	if !ok {
-		client.Conn.WriteJSON(models.Message{
-			Type:    "error",
-			Payload: "Invalid payload",
-		})
+	// Validate required fields
+	if username == "" {
+		wss.joinFailed(client, msg, models.ErrCodeInvalidUsername, "Username is required")
 		return
 	}
 
-	// Validate required fields
-	username, ok := payload["username"].(string)
-	if !ok || username == "" {
-		client.Conn.WriteJSON(models.Message{
-			Type:    "error",
-			Payload: "Username is required",
-		})
+	if !utils.ValidateUsername(username) {
+		wss.joinFailed(client, msg, models.ErrCodeInvalidUsername, "Invalid username")
 		return
 	}
 
-	avatarID, ok := payload["avatarId"].(string)
-	if !ok || avatarID == "" {
-		client.Conn.WriteJSON(models.Message{
-			Type:    "error",
-			Payload: "AvatarID is required",
-		})
+	if avatarID == "" {
+		wss.joinFailed(client, msg, models.ErrCodeInvalidAvatar, "AvatarID is required")
 		return
 	}
 
 	// Validate avatar ID
-	validAvatars := map[string]bool{
-		"kazuha":  true,
-		"diluc":   true,
-		"ganyu":   true,
-		"hutao":   true,
-		"shotgun": true,
-		"shenhe":  true,
-	}
-
-	if !validAvatars[avatarID] {
-		client.Conn.WriteJSON(models.Message{
-			Type:    "error",
-			Payload: "Invalid avatar ID",
-		})
+	if !utils.ValidateAvatarID(avatarID) {
+		wss.joinFailed(client, msg, models.ErrCodeInvalidAvatar, "Invalid avatar ID")
 		return
 	}
 
-	// Update client info
-	client.Username = username
-	client.AvatarID = avatarID
-	client.UserID = msg.UserID
-
-	wss.mu.Lock()
-	defer wss.mu.Unlock()
+	// Snapshot what the password check needs; bcrypt is too slow to run
+	// while holding the room lock
+	stored, unlock, err := wss.lookupRoom(roomID)
+	var isPublic, banned bool
+	var creator, passwordHash string
+	if err == nil {
+		isPublic, creator, passwordHash = stored.IsPublic, stored.Creator, stored.PasswordHash
+		banned = stored.Bans[client.UserID]
+	}
+	unlock()
 
-	room, exists := wss.rooms[roomID]
-	if !exists {
-		client.Conn.WriteJSON(models.Message{
-			Type:   "room_not_found",
+	if errors.Is(err, db.ErrRoomNotFound) {
+		wss.metrics.joinFailures.WithLabelValues(models.MessageRoomNotFound).Inc()
+		reply(client, msg, models.Message{
+			Type:   models.MessageRoomNotFound,
 			RoomID: roomID,
-			Payload: map[string]interface{}{
-				"suggestedName": utils.GenerateRoomName(),
-				"createRoom":    true,
+			Payload: models.RoomNotFoundPayload{
+				SuggestedName: utils.GenerateRoomName(),
+				CreateRoom:    true,
 			},
 		})
 		return
 	}
+	if err != nil {
+		log.Printf("error loading room %s: %v", roomID, err)
+		wss.joinFailed(client, msg, models.ErrCodeInternal, "Failed to load room")
+		return
+	}
 
-	if !room.IsPublic {
-		password, _ := payload["password"].(string)
-		if password != room.Password {
-			client.Conn.WriteJSON(models.Message{
-				Type:    "error",
-				Payload: "Invalid password",
-			})
+	if banned {
+		wss.joinFailed(client, msg, models.ErrCodeBanned, "You are banned from this room")
+		return
+	}
+
+	var inviteID string
+	if !isPublic && payload.InviteToken != "" {
+		// An invite stands in for the password and bypasses the lockout
+		var ok bool
+		if inviteID, ok = wss.redeemInvite(roomID, client.UserID, payload.InviteToken); !ok {
+			wss.joinFailed(client, msg, models.ErrCodeInvalidInvite, "Invalid or expired invite")
+			return
+		}
+	} else if !isPublic {
+		switch check, wait := wss.checkJoinPassword(roomID, creator, passwordHash, client.UserID, client.IP, payload.Password); check {
+		case joinLockedOut:
+			wss.metrics.joinFailures.WithLabelValues(models.ErrCodeJoinLockedOut).Inc()
+			sendErrorPayload(client, msg, newLockoutError(lockoutSeconds(wait)))
 			return
+		case joinBadPassword:
+			wss.joinFailed(client, msg, models.ErrCodeInvalidPassword, "Invalid password")
+			return
+		}
+	}
+
+	// Someone may have brought the room live while the password was checked
+	room := wss.activateRoom(stored)
+	defer room.mu.Unlock()
+
+	if room.Bans[client.UserID] {
+		wss.closeIfEmpty(room)
+		if inviteID != "" {
+			// Not while holding the room lock
+			go wss.releaseInvite(roomID, inviteID)
 		}
+		wss.joinFailed(client, msg, models.ErrCodeBanned, "You are banned from this room")
+		return
 	}
 
+	wss.dropDetachedMember(room, client.UserID)
+
+	wss.mu.Lock()
 	// Get current room members before adding the new user
-	members := make([]map[string]string, 0)
+	members := make([]models.MemberInfo, 0)
 	for conn := range room.Members {
 		if memberClient, exists := wss.clients[conn]; exists {
-			members = append(members, map[string]string{
-				"userId":   memberClient.UserID,
-				"username": memberClient.Username,
-				"avatarId": memberClient.AvatarID,
-			})
+			members = append(members, memberInfo(room.Room, memberClient))
 		}
 	}
 
+	for _, member := range wss.remote.members(roomID) {
+		// Unless users may have several sessions, this is one the new
+		// connection replaced, which its instance drops on hearing of it
+		if member.UserID == client.UserID && wss.config.SessionPolicy != config.SessionMultiple {
+			continue
+		}
+		member.Role = roleOf(room.Room, member.UserID)
+		members = append(members, member)
+	}
+
 	// Add new member
+	client.Username = username
+	client.AvatarID = avatarID
 	room.Members[client.Conn] = client.Username
-	client.RoomIDs = append(client.RoomIDs, roomID)
+	if !slices.Contains(client.RoomIDs, roomID) {
+		client.RoomIDs = append(client.RoomIDs, roomID)
+	}
 
 	// Add the new member to the members list
-	members = append(members, map[string]string{
-		"userId":   client.UserID,
-		"username": client.Username,
-		"avatarId": client.AvatarID,
-	})
+	newMemberInfo := memberInfo(room.Room, client)
+	members = append(members, newMemberInfo)
+	resumeToken := wss.resumeToken(client)
+	wss.mu.Unlock()
+	go wss.touchUser(client.UserID)
 
 	// Send current members to the new user
-	client.Conn.WriteJSON(models.Message{
-		Type:   "room_joined",
+	reply(client, msg, models.Message{
+		Type:   models.MessageRoomJoined,
 		RoomID: roomID,
-		Payload: map[string]interface{}{
-			"members":  members,
-			"name":     room.Name,
-			"isPublic": room.IsPublic,
+		Payload: models.RoomJoinedPayload{
+			Members:     members,
+			Name:        room.Name,
+			IsPublic:    room.IsPublic,
+			ICEServers:  wss.config.ICEServers,
+			ResumeToken: resumeToken,
 		},
 	})
 
-	newMemberInfo := map[string]string{
-		"userId":   client.UserID,
-		"username": client.Username,
-		"avatarId": client.AvatarID,
-	}
-
 	// Notify other members about the new user
-	for conn := range room.Members {
-		if conn != client.Conn {
-			conn.WriteJSON(models.Message{
-				Type:   "user_joined",
-				RoomID: roomID,
-				UserID: client.UserID,
-				Payload: map[string]interface{}{
-					"user": newMemberInfo,
-					"name": room.Name,
-				},
-			})
-		}
-	}
+	wss.broadcastExcept(room, client.Conn, models.Message{
+		Type:   models.MessageUserJoined,
+		RoomID: roomID,
+		UserID: client.UserID,
+		Payload: models.UserJoinedPayload{
+			User: newMemberInfo,
+			Name: room.Name,
+		},
+	})
+	sendAck(client, msg)
 }
 
-func (wss *WebSocketServer) handleCreateRoom(client *models.Client, msg models.Message) {
-	payload, ok := msg.Payload.(map[string]interface{})
-	if !ok {
-		client.Conn.WriteJSON(models.Message{
-			Type:    "error",
-			Payload: "Invalid payload",
-		})
-		return
-	}
-
+func (wss *WebSocketServer) handleCreateRoom(client *models.Client, msg models.Message, payload *models.CreateRoomPayload) {
 	roomID := msg.RoomID // Use provided roomID if exists
 	if roomID != "" {
 		// Validate the provided room ID
 		if !utils.ValidateRoomID(roomID) {
-			client.Conn.WriteJSON(models.Message{
-				Type:    "error",
-				Payload: "Invalid room ID format. Must be 8 characters long and contain only letters and numbers",
-			})
+			sendError(client, msg, models.ErrCodeInvalidRoomID, "Invalid room ID format. Must be 8 characters long and contain only letters and numbers")
 			return
 		}
 	} else {
 		roomID = utils.GenerateShortID()
 	}
 
-	// Check if room ID already exists
-	if wss.RoomExists(roomID) {
-		client.Conn.WriteJSON(models.Message{
-			Type:    "error",
-			Payload: "Room ID already exists",
-		})
-		return
-	}
-
-	roomName, _ := payload["name"].(string)
+	roomName := payload.Name
 	if roomName == "" {
 		roomName = utils.GenerateRoomName()
 	}
 
-	isPublic, _ := payload["isPublic"].(bool)
-	password, _ := payload["password"].(string)
+	passwordHash, err := auth.HashPassword(payload.Password, wss.config.PasswordCost)
+	if errors.Is(err, auth.ErrPasswordTooLong) {
+		sendErrorPayload(client, msg, models.ErrorPayload{
+			Code:    models.ErrCodePasswordTooLong,
+			Message: "Password too long",
+			Details: map[string]interface{}{"maxLength": auth.MaxPasswordLength},
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("error hashing room password: %v", err)
+		sendError(client, msg, models.ErrCodeInternal, "Failed to create room")
+		return
+	}
 
 	room := &models.Room{
-		ID:       roomID,
-		Name:     roomName,
-		Creator:  client.UserID,
-		IsPublic: isPublic,
-		Password: password,
-		Members:  make(map[*websocket.Conn]string),
+		ID:           roomID,
+		Name:         roomName,
+		Creator:      client.UserID,
+		IsPublic:     payload.IsPublic,
+		PasswordHash: passwordHash,
+		Members:      make(map[*websocket.Conn]string),
 	}
 
-	wss.mu.Lock()
-	wss.rooms[roomID] = room
-	wss.mu.Unlock()
+	if err := wss.store.CreateRoom(room); err != nil {
+		if errors.Is(err, db.ErrRoomExists) {
+			sendError(client, msg, models.ErrCodeRoomExists, "Room ID already exists")
+			return
+		}
+		log.Printf("error creating room %s: %v", roomID, err)
+		sendError(client, msg, models.ErrCodeInternal, "Failed to create room")
+		return
+	}
 
-	client.Conn.WriteJSON(models.Message{
-		Type:   "room_created",
+	reply(client, msg, models.Message{
+		Type:   models.MessageRoomCreated,
 		RoomID: roomID,
-		Payload: map[string]interface{}{
-			"name":     roomName,
-			"isPublic": isPublic,
-			"creator":  client.UserID,
+		Payload: models.RoomCreatedPayload{
+			Name:     roomName,
+			IsPublic: payload.IsPublic,
+			Creator:  client.UserID,
 		},
 	})
+	sendAck(client, msg)
 }
 
 func (wss *WebSocketServer) handleLeaveRoom(client *models.Client, msg models.Message) {
 	roomID := msg.RoomID
 
-	wss.mu.Lock()
-	defer wss.mu.Unlock()
-
-	room, exists := wss.rooms[roomID]
-	if !exists {
+	room := wss.lockRoom(roomID)
+	if room == nil || !wss.inRoom(client, roomID) {
+		if room != nil {
+			room.mu.Unlock()
+		}
+		sendError(client, msg, models.ErrCodeNotInRoom, "You are not in this room")
 		return
 	}
+	defer room.mu.Unlock()
 
-	delete(room.Members, client.Conn)
+	wss.removeFromRoom(room, client, true)
+	wss.closeIfEmpty(room)
+	sendAck(client, msg)
+}
 
-	// Remove room from client's room list
-	for i, id := range client.RoomIDs {
-		if id == roomID {
-			client.RoomIDs = append(client.RoomIDs[:i], client.RoomIDs[i+1:]...)
-			break
-		}
-	}
+// handleSignal forwards an untyped signal without looking inside it.
+//
+// Deprecated: clients should send signal_offer, signal_answer and
+// signal_candidate instead. This stays until cached clients have updated.
+func (wss *WebSocketServer) handleSignal(client *models.Client, msg models.Message, payload *models.LegacySignalPayload) {
+	legacySignalWarning.Do(func() {
+		log.Printf("clients are still sending deprecated signal messages")
+	})
 
-	// Notify other members with full user info
-	leavingMemberInfo := map[string]string{
-		"userId":   client.UserID,
-		"username": client.Username,
-		"avatarId": client.AvatarID,
-	}
+	rawTarget, targeted := (*payload)["toUserId"]
+	toUserID, _ := rawTarget.(string)
 
-	for conn := range room.Members {
-		conn.WriteJSON(models.Message{
-			Type:    "user_left",
-			RoomID:  roomID,
-			UserID:  client.UserID,
-			Payload: leavingMemberInfo,
-		})
-	}
+	wss.forwardSignal(client, msg, models.Message{
+		Type:    models.MessageSignal,
+		RoomID:  msg.RoomID,
+		UserID:  client.UserID,
+		Payload: *payload,
+	}, toUserID, targeted)
+}
 
-	// If room is empty, delete it
-	if len(room.Members) == 0 {
-		delete(wss.rooms, roomID)
+// memberInfo describes client as a member of room. Callers must hold
+// wss.mu.
+func memberInfo(room *models.Room, client *models.Client) models.MemberInfo {
+	return models.MemberInfo{
+		UserID:   client.UserID,
+		Username: client.Username,
+		AvatarID: client.AvatarID,
+		Role:     roleOf(room, client.UserID),
+		Presence: client.Presence,
 	}
 }
 
-func (wss *WebSocketServer) handleSignal(client *models.Client, msg models.Message) {
-	roomID := msg.RoomID
+// memberConns returns the connections userID has in room. Callers must
+// hold room.mu.
+func (wss *WebSocketServer) memberConns(room *liveRoom, userID string) []*websocket.Conn {
+	if userID == "" {
+		return nil
+	}
 
 	wss.mu.RLock()
-	room, exists := wss.rooms[roomID]
-	if !exists {
-		wss.mu.RUnlock()
-		return
-	}
+	defer wss.mu.RUnlock()
 
-	// Forward the signal to all other members in the room
+	var conns []*websocket.Conn
 	for conn := range room.Members {
-		if conn != client.Conn {
-			conn.WriteJSON(models.Message{
-				Type:    "signal",
-				RoomID:  roomID,
-				UserID:  client.UserID,
-				Payload: msg.Payload,
-			})
+		if member, exists := wss.clients[conn]; exists && member.UserID == userID {
+			conns = append(conns, conn)
 		}
 	}
-	wss.mu.RUnlock()
+	return conns
 }
 
-// Add this method to clean up empty rooms periodically
-func (wss *WebSocketServer) cleanupEmptyRooms() {
-	wss.mu.Lock()
-	defer wss.mu.Unlock()
+// redeemInvite checks an invite token for roomID and uses up one join from
+// it on behalf of userID. It returns the invite's ID, for releaseInvite if
+// the join fails after all.
+func (wss *WebSocketServer) redeemInvite(roomID, userID, token string) (string, bool) {
+	claims, err := wss.keys.Verify(token, auth.PurposeInvite)
+	if err != nil || claims.RoomID != roomID {
+		return "", false
+	}
 
-	for roomID, room := range wss.rooms {
-		if len(room.Members) == 0 {
-			delete(wss.rooms, roomID)
-		}
+	err = wss.invites.RedeemInvite(roomID, claims.Subject, userID)
+	if err != nil && !errors.Is(err, db.ErrInviteUnusable) {
+		log.Printf("error redeeming invite %s: %v", claims.Subject, err)
 	}
+	return claims.Subject, err == nil
 }
 
-// Add this new helper function
-func (wss *WebSocketServer) removeClientFromAllRooms(client *models.Client) {
-	for _, roomID := range client.RoomIDs {
-		room, exists := wss.rooms[roomID]
-		if !exists {
-			continue
-		}
+// releaseInvite gives back the join redeemInvite used up.
+func (wss *WebSocketServer) releaseInvite(roomID, inviteID string) {
+	if err := wss.invites.ReleaseInvite(roomID, inviteID); err != nil {
+		log.Printf("error releasing invite %s: %v", inviteID, err)
+	}
+}
 
-		delete(room.Members, client.Conn)
+// rehashRoomPassword replaces a room's password hash with one made at the
+// configured cost, unless the password changed in the meantime. The room
+// lock is only taken to swap in the new hash.
+func (wss *WebSocketServer) rehashRoomPassword(roomID, oldHash, password string) {
+	newHash, err := auth.HashPassword(password, wss.config.PasswordCost)
+	if err != nil {
+		log.Printf("error rehashing password for room %s: %v", roomID, err)
+		return
+	}
 
-		// Notify other members about the disconnection
-		leavingMemberInfo := map[string]string{
-			"userId":   client.UserID,
-			"username": client.Username,
-			"avatarId": client.AvatarID,
-		}
+	err = wss.store.ReplacePasswordHash(roomID, oldHash, newHash)
+	if errors.Is(err, db.ErrRoomNotFound) {
+		return
+	}
+	if err != nil {
+		log.Printf("error rehashing password for room %s: %v", roomID, err)
+		return
+	}
 
-		for conn := range room.Members {
-			conn.WriteJSON(models.Message{
-				Type:    "user_left",
-				RoomID:  roomID,
-				UserID:  client.UserID,
-				Payload: leavingMemberInfo,
-			})
+	if room := wss.lockRoom(roomID); room != nil {
+		if room.PasswordHash == oldHash {
+			room.PasswordHash = newHash
 		}
+		room.mu.Unlock()
+	}
+}
 
-		// If room is empty, delete it
-		if len(room.Members) == 0 {
-			delete(wss.rooms, roomID)
+// touchUser records that a user was just seen. Unknown users are ignored.
+func (wss *WebSocketServer) touchUser(userID string) {
+	if err := wss.users.TouchUser(userID); err != nil && !errors.Is(err, db.ErrUserNotFound) {
+		log.Printf("error updating last seen for %s: %v", userID, err)
+	}
+}
+
+// removeClientFromAllRooms drops client from every room it is in, telling
+// the other members it left.
+func (wss *WebSocketServer) removeClientFromAllRooms(client *models.Client) {
+	for _, roomID := range wss.roomIDsOf(client) {
+		if room := wss.lockRoom(roomID); room != nil {
+			wss.removeFromRoom(room, client, true)
+			wss.closeIfEmpty(room)
+			room.mu.Unlock()
 		}
 	}
 }
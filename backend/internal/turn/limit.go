@@ -0,0 +1,206 @@
+package turn
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// bandwidthLimiter caps the traffic each Portal user can push through the
+// TURN server. Client addresses are tied to a user when they authenticate,
+// and every address of a user draws from the same token bucket.
+type bandwidthLimiter struct {
+	rate int // Bytes per second per user, 0 for unlimited
+
+	mu      sync.Mutex
+	owners  map[string]addrOwner
+	buckets map[string]*tokenBucket
+}
+
+type addrOwner struct {
+	userID    string
+	expiresAt time.Time
+}
+
+func newBandwidthLimiter(rate int) *bandwidthLimiter {
+	return &bandwidthLimiter{
+		rate:    rate,
+		owners:  make(map[string]addrOwner),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// assign records that addr authenticated as userID with a credential that
+// expires at expiresAt.
+func (l *bandwidthLimiter) assign(addr net.Addr, userID string, expiresAt time.Time) {
+	if l.rate == 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.owners[addr.String()] = addrOwner{userID: userID, expiresAt: expiresAt}
+	if _, exists := l.buckets[userID]; !exists {
+		l.buckets[userID] = newTokenBucket(l.rate)
+	}
+}
+
+// bucketFor returns the bucket charged for traffic to or from addr, or nil
+// if addr has not authenticated.
+func (l *bandwidthLimiter) bucketFor(addr net.Addr) *tokenBucket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	owner, exists := l.owners[addr.String()]
+	if !exists {
+		return nil
+	}
+	return l.buckets[owner.userID]
+}
+
+// sweep forgets addresses whose credentials expired and buckets nobody
+// uses anymore.
+func (l *bandwidthLimiter) sweep() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	inUse := make(map[string]bool)
+	for addr, owner := range l.owners {
+		if now.After(owner.expiresAt) {
+			delete(l.owners, addr)
+			continue
+		}
+		inUse[owner.userID] = true
+	}
+	for userID := range l.buckets {
+		if !inUse[userID] {
+			delete(l.buckets, userID)
+		}
+	}
+}
+
+func (l *bandwidthLimiter) wrapPacketConn(conn net.PacketConn) net.PacketConn {
+	if l.rate == 0 {
+		return conn
+	}
+	return &limitedPacketConn{PacketConn: conn, limiter: l}
+}
+
+func (l *bandwidthLimiter) wrapListener(listener net.Listener) net.Listener {
+	if l.rate == 0 {
+		return listener
+	}
+	return &limitedListener{Listener: listener, limiter: l}
+}
+
+// limitedPacketConn drops UDP datagrams once a user is over budget, the
+// same way a congested link would.
+type limitedPacketConn struct {
+	net.PacketConn
+	limiter *bandwidthLimiter
+}
+
+func (c *limitedPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil {
+			return n, addr, err
+		}
+		if bucket := c.limiter.bucketFor(addr); bucket == nil || bucket.allow(n) {
+			return n, addr, nil
+		}
+	}
+}
+
+func (c *limitedPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if bucket := c.limiter.bucketFor(addr); bucket != nil && !bucket.allow(len(p)) {
+		return len(p), nil
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+// limitedConn slows a TCP connection down instead, since dropping bytes
+// would corrupt the stream.
+type limitedListener struct {
+	net.Listener
+	limiter *bandwidthLimiter
+}
+
+func (l *limitedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &limitedConn{Conn: conn, limiter: l.limiter}, nil
+}
+
+type limitedConn struct {
+	net.Conn
+	limiter *bandwidthLimiter
+}
+
+func (c *limitedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if bucket := c.limiter.bucketFor(c.RemoteAddr()); bucket != nil && n > 0 {
+		bucket.wait(n)
+	}
+	return n, err
+}
+
+func (c *limitedConn) Write(p []byte) (int, error) {
+	if bucket := c.limiter.bucketFor(c.RemoteAddr()); bucket != nil {
+		bucket.wait(len(p))
+	}
+	return c.Conn.Write(p)
+}
+
+// tokenBucket refills at rate bytes per second and holds at most one
+// second's worth.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int) *tokenBucket {
+	return &tokenBucket{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+func (b *tokenBucket) refill() {
+	now := time.Now()
+	b.tokens = min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// allow takes n tokens if they are available.
+func (b *tokenBucket) allow(n int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill()
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// wait takes n tokens, sleeping until the debt they leave is repaid.
+func (b *tokenBucket) wait(n int) {
+	b.mu.Lock()
+	b.refill()
+	b.tokens -= float64(n)
+	debt := -b.tokens
+	b.mu.Unlock()
+
+	if debt > 0 {
+		time.Sleep(time.Duration(debt / b.rate * float64(time.Second)))
+	}
+}
@@ -0,0 +1,195 @@
+// Package turn runs an optional embedded TURN/STUN server for deployments
+// that do not want to run coturn alongside Portal.
+package turn
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"portal/internal/auth"
+	"portal/internal/config"
+	"portal/internal/db"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/logging"
+	pionturn "github.com/pion/turn/v4"
+)
+
+// userCacheTTL is how long a user ID confirmed against the database is
+// trusted before being looked up again. TURN clients authenticate every
+// refresh and permission request, so this keeps the database out of the
+// hot path.
+const userCacheTTL = time.Minute
+
+type Server struct {
+	turn    *pionturn.Server
+	config  *config.Config
+	users   db.UserStore
+	limiter *bandwidthLimiter
+
+	mu        sync.Mutex
+	knownUser map[string]time.Time
+	done      chan struct{}
+}
+
+// Start listens on the configured UDP and TCP ports and serves TURN
+// allocations to holders of credentials minted by auth.TURNCredentials.
+func Start(cfg *config.Config, users db.UserStore) (*Server, error) {
+	if cfg.TURNSecret == "" {
+		return nil, errors.New("TURN_SECRET is required for the embedded TURN server")
+	}
+
+	relayIP := net.ParseIP(cfg.TURNRelayIP)
+	if relayIP == nil {
+		return nil, fmt.Errorf("invalid TURN_RELAY_IP %q", cfg.TURNRelayIP)
+	}
+
+	s := &Server{
+		config:    cfg,
+		users:     users,
+		limiter:   newBandwidthLimiter(cfg.TURNUserBandwidth),
+		knownUser: make(map[string]time.Time),
+		done:      make(chan struct{}),
+	}
+
+	newRelayGenerator := func() pionturn.RelayAddressGenerator {
+		return &pionturn.RelayAddressGeneratorPortRange{
+			RelayAddress: relayIP,
+			Address:      cfg.TURNRelayBindAddress,
+			MinPort:      cfg.TURNRelayMinPort,
+			MaxPort:      cfg.TURNRelayMaxPort,
+		}
+	}
+
+	serverConfig := pionturn.ServerConfig{
+		Realm:         cfg.TURNRealm,
+		AuthHandler:   s.authenticate,
+		LoggerFactory: logging.NewDefaultLoggerFactory(),
+	}
+
+	if cfg.TURNUDPPort != 0 {
+		udpConn, err := net.ListenPacket("udp4", net.JoinHostPort(cfg.TURNListenAddress, strconv.Itoa(cfg.TURNUDPPort)))
+		if err != nil {
+			return nil, fmt.Errorf("listening for TURN over UDP: %w", err)
+		}
+		serverConfig.PacketConnConfigs = append(serverConfig.PacketConnConfigs, pionturn.PacketConnConfig{
+			PacketConn:            s.limiter.wrapPacketConn(udpConn),
+			RelayAddressGenerator: newRelayGenerator(),
+		})
+	}
+
+	if cfg.TURNTCPPort != 0 {
+		tcpListener, err := net.Listen("tcp4", net.JoinHostPort(cfg.TURNListenAddress, strconv.Itoa(cfg.TURNTCPPort)))
+		if err != nil {
+			closePacketConns(serverConfig.PacketConnConfigs)
+			return nil, fmt.Errorf("listening for TURN over TCP: %w", err)
+		}
+		serverConfig.ListenerConfigs = append(serverConfig.ListenerConfigs, pionturn.ListenerConfig{
+			Listener:              s.limiter.wrapListener(tcpListener),
+			RelayAddressGenerator: newRelayGenerator(),
+		})
+	}
+
+	if len(serverConfig.PacketConnConfigs) == 0 && len(serverConfig.ListenerConfigs) == 0 {
+		return nil, errors.New("the embedded TURN server needs a UDP or TCP port")
+	}
+
+	turnServer, err := pionturn.NewServer(serverConfig)
+	if err != nil {
+		closePacketConns(serverConfig.PacketConnConfigs)
+		for _, listener := range serverConfig.ListenerConfigs {
+			listener.Listener.Close()
+		}
+		return nil, err
+	}
+	s.turn = turnServer
+
+	go s.sweepLoop()
+	return s, nil
+}
+
+// authenticate accepts TURN REST API usernames (expiry:userID) that have
+// not expired and belong to a Portal user, and returns the long-term
+// credential key derived from the shared secret.
+func (s *Server) authenticate(username, realm string, srcAddr net.Addr) ([]byte, bool) {
+	expiryText, userID, found := strings.Cut(username, ":")
+	if !found || userID == "" {
+		return nil, false
+	}
+
+	expiry, err := strconv.ParseInt(expiryText, 10, 64)
+	if err != nil || time.Now().Unix() >= expiry {
+		return nil, false
+	}
+
+	if !s.userExists(userID) {
+		return nil, false
+	}
+
+	s.limiter.assign(srcAddr, userID, time.Unix(expiry, 0))
+	return pionturn.GenerateAuthKey(username, realm, auth.TURNPassword(s.config.TURNSecret, username)), true
+}
+
+func (s *Server) userExists(userID string) bool {
+	s.mu.Lock()
+	checkedAt, cached := s.knownUser[userID]
+	s.mu.Unlock()
+	if cached && time.Since(checkedAt) < userCacheTTL {
+		return true
+	}
+
+	_, err := s.users.GetUser(userID)
+	if err != nil {
+		if !errors.Is(err, db.ErrUserNotFound) {
+			log.Printf("error checking TURN user %s: %v", userID, err)
+		}
+		return false
+	}
+
+	s.mu.Lock()
+	s.knownUser[userID] = time.Now()
+	s.mu.Unlock()
+	return true
+}
+
+func (s *Server) sweepLoop() {
+	ticker := time.NewTicker(userCacheTTL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.limiter.sweep()
+
+			s.mu.Lock()
+			for userID, checkedAt := range s.knownUser {
+				if time.Since(checkedAt) >= userCacheTTL {
+					delete(s.knownUser, userID)
+				}
+			}
+			s.mu.Unlock()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// AllocationCount returns the number of active relay allocations.
+func (s *Server) AllocationCount() int {
+	return s.turn.AllocationCount()
+}
+
+func (s *Server) Close() error {
+	close(s.done)
+	return s.turn.Close()
+}
+
+func closePacketConns(configs []pionturn.PacketConnConfig) {
+	for _, c := range configs {
+		c.PacketConn.Close()
+	}
+}
@@ -0,0 +1,204 @@
+package turn
+
+import (
+	"net"
+	"portal/internal/auth"
+	"portal/internal/config"
+	"portal/internal/db"
+	"portal/internal/models"
+	"strconv"
+	"testing"
+	"time"
+
+	pionturn "github.com/pion/turn/v4"
+)
+
+const testSecret = "turn-secret-0123456789"
+
+// userSet is a UserStore that knows a fixed set of user IDs.
+type userSet map[string]bool
+
+func (s userSet) CreateUser() (string, error)        { return "", nil }
+func (s userSet) UpdateUser(user *models.User) error { return nil }
+func (s userSet) TouchUser(id string) error          { return nil }
+
+func (s userSet) GetUser(id string) (*models.User, error) {
+	if !s[id] {
+		return nil, db.ErrUserNotFound
+	}
+	return &models.User{ID: id}, nil
+}
+
+// freeUDPPort returns a loopback UDP port nothing is listening on, since a
+// zero port turns the TURN listener off.
+func freeUDPPort(t *testing.T) int {
+	t.Helper()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// startServer runs the TURN server over UDP on 127.0.0.1 and returns its
+// address.
+func startServer(t *testing.T, bandwidth int) string {
+	t.Helper()
+	cfg := &config.Config{
+		TURNSecret:           testSecret,
+		TURNRealm:            "portal",
+		TURNListenAddress:    "127.0.0.1",
+		TURNUDPPort:          freeUDPPort(t),
+		TURNRelayIP:          "127.0.0.1",
+		TURNRelayBindAddress: "127.0.0.1",
+		TURNRelayMinPort:     49152,
+		TURNRelayMaxPort:     65535,
+		TURNUserBandwidth:    bandwidth,
+	}
+	s, err := Start(cfg, userSet{"alice": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return net.JoinHostPort(cfg.TURNListenAddress, strconv.Itoa(cfg.TURNUDPPort))
+}
+
+// allocate connects to the server at addr and asks it for a relay.
+func allocate(t *testing.T, addr, username, password string) (net.PacketConn, error) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	client, err := pionturn.NewClient(&pionturn.ClientConfig{
+		STUNServerAddr: addr,
+		TURNServerAddr: addr,
+		Conn:           conn,
+		Username:       username,
+		Password:       password,
+		Realm:          "portal",
+		RTO:            100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Close)
+	if err := client.Listen(); err != nil {
+		t.Fatal(err)
+	}
+
+	relay, err := client.Allocate()
+	if err != nil {
+		return nil, err
+	}
+	t.Cleanup(func() { relay.Close() })
+	return relay, nil
+}
+
+func TestAllocate(t *testing.T) {
+	addr := startServer(t, 0)
+
+	expired := func(userID string) (string, string) {
+		username := "1:" + userID
+		return username, auth.TURNPassword(testSecret, username)
+	}
+	minted := func(secret, userID string) (string, string) {
+		username, password, _ := auth.TURNCredentials(secret, userID, time.Hour)
+		return username, password
+	}
+
+	tests := []struct {
+		name        string
+		credentials func() (string, string)
+		ok          bool
+	}{
+		{name: "known user", credentials: func() (string, string) { return minted(testSecret, "alice") }, ok: true},
+		{name: "unknown user", credentials: func() (string, string) { return minted(testSecret, "mallory") }},
+		{name: "wrong secret", credentials: func() (string, string) { return minted("other-secret-0123456789", "alice") }},
+		{name: "expired", credentials: func() (string, string) { return expired("alice") }},
+		{name: "no user ID", credentials: func() (string, string) { return minted(testSecret, "") }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			username, password := tt.credentials()
+			relay, err := allocate(t, addr, username, password)
+			if (err == nil) != tt.ok {
+				t.Fatalf("Allocate() err = %v, want success: %v", err, tt.ok)
+			}
+			if tt.ok && relay.LocalAddr() == nil {
+				t.Fatal("no relayed address")
+			}
+		})
+	}
+}
+
+func TestUserBandwidth(t *testing.T) {
+	const rate = 16 * 1024
+	addr := startServer(t, rate)
+
+	username, password, _ := auth.TURNCredentials(testSecret, "alice", time.Hour)
+	relay, err := allocate(t, addr, username, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peer, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	// The first write installs the permission, which is itself traffic
+	// the bucket has to allow, so settle it before flooding
+	if _, err := relay.WriteTo([]byte("hello"), peer.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := peer.ReadFrom(buf); err != nil {
+		t.Fatalf("relayed hello: %v", err)
+	}
+
+	received := make(chan int)
+	go func() {
+		total := 0
+		for {
+			peer.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+			n, _, err := peer.ReadFrom(buf)
+			if err != nil {
+				received <- total
+				return
+			}
+			total += n
+		}
+	}()
+
+	// Offer about ten times the budget for a second
+	const window = time.Second
+	packet := make([]byte, 1000)
+	sent := 0
+	start := time.Now()
+	for time.Since(start) < window {
+		if _, err := relay.WriteTo(packet, peer.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		sent += len(packet)
+		time.Sleep(5 * time.Millisecond)
+	}
+	total := <-received
+
+	// A full bucket plus one window's refill, with room for headers
+	if limit := 2 * rate * 11 / 10; total > limit {
+		t.Errorf("relayed %d of %d bytes in %v, want at most %d", total, sent, window, limit)
+	}
+	if total == 0 {
+		t.Error("nothing relayed")
+	}
+	if sent < 4*rate {
+		t.Fatalf("only offered %d bytes, too little to test the limit", sent)
+	}
+}
@@ -3,15 +3,28 @@ package utils
 import (
 	"math/rand"
 	"regexp"
+	"strings"
 	"time"
+	"unicode/utf8"
 )
 
+const MaxUsernameLength = 32
+
 var (
 	// Create a local random generator
 	rng = rand.New(rand.NewSource(time.Now().UnixNano()))
 
 	roomIDPattern = regexp.MustCompile(`^[a-zA-Z0-9]{8}$`)
 
+	validAvatars = map[string]bool{
+		"kazuha":  true,
+		"diluc":   true,
+		"ganyu":   true,
+		"hutao":   true,
+		"shotgun": true,
+		"shenhe":  true,
+	}
+
 	adjectives = []string{
 		"Fluffy", "Adorable", "Bouncy", "Cheerful", "Dancing",
 		"Elegant", "Friendly", "Gentle", "Happy", "Jolly",
@@ -33,6 +46,15 @@ func ValidateRoomID(id string) bool {
 	return roomIDPattern.MatchString(id)
 }
 
+func ValidateUsername(name string) bool {
+	trimmed := strings.TrimSpace(name)
+	return trimmed != "" && trimmed == name && utf8.RuneCountInString(name) <= MaxUsernameLength
+}
+
+func ValidateAvatarID(id string) bool {
+	return validAvatars[id]
+}
+
 func GenerateRoomName() string {
 	adj := adjectives[rng.Intn(len(adjectives))]
 	noun := nouns[rng.Intn(len(nouns))]
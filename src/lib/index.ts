@@ -3,6 +3,15 @@ export function lerp(start: number, end: number, factor: number) {
 	return start + (end - start) * factor;
 }
 
+// Session tokens go in the Authorization header on REST calls. WebSocket
+// upgrades cannot carry headers from a browser, so the token is offered as a
+// subprotocol next to the JSON codec the server actually selects.
+export const authHeaders = (token: string | null): Record<string, string> =>
+	token ? { Authorization: `Bearer ${token}` } : {};
+
+export const websocketProtocols = (token: string | null) =>
+	token ? ['portal.json', `portal.token.${token}`] : ['portal.json'];
+
 export const backendHealthChecker = async (API_URL: string) => {
 	try {
 		const response = await fetch(`${API_URL}/health`, {
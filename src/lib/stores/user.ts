@@ -4,13 +4,15 @@ interface User {
     username: string;
     avatarId: string;
     userId: string | null;
+    token: string | null;
 }
 
 function createUserStore() {
     const { subscribe, set, update } = writable<User>({
         username: '',
         avatarId: '',
-        userId: null
+        userId: null,
+        token: null
     });
 
     return {
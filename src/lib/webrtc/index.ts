@@ -1,4 +1,5 @@
 import { PUBLIC_API_URL } from '$env/static/public';
+import { websocketProtocols } from '@/index';
 
 interface Member {
 	userId: string;
@@ -25,10 +26,11 @@ export class WebRTCChat {
 		private roomId: string,
 		private userId: string,
 		private username: string,
-		private avatarId: string
+		private avatarId: string,
+		token: string
 	) {
 		const baseUrl = PUBLIC_API_URL.replace('http://', 'ws://');
-		this.ws = new WebSocket(`${baseUrl}/ws`);
+		this.ws = new WebSocket(`${baseUrl}/ws`, websocketProtocols(token));
 		this.setupWebSocket();
 	}
 
@@ -10,10 +10,12 @@ export const load: LayoutServerLoad = async ({ cookies }) => {
 	let username = cookies.get('username');
 	let avatarId = cookies.get('avatarId');
 	let userId = cookies.get('userId');
+	let token = cookies.get('sessionToken');
 
 	const backendAvailable = await backendHealthChecker(env.API_URL);
 
-	if (!userId) {
+	// A user ID is only usable with its session token, so start over without one
+	if (!userId || !token) {
 		try {
 			const response = await fetch(`${env.API_URL}/api/users`, {
 				method: 'POST',
@@ -29,8 +31,9 @@ export const load: LayoutServerLoad = async ({ cookies }) => {
 
 			const data = await response.json();
 			userId = data.userId;
+			token = data.token;
 
-			if (userId) {
+			if (userId && token) {
 				cookies.set('userId', userId, {
 					path: '/',
 					maxAge: 60 * 60 * 24 * 365, // 1 year
@@ -38,8 +41,17 @@ export const load: LayoutServerLoad = async ({ cookies }) => {
 					secure: false,
 					sameSite: 'lax'
 				});
+
+				// Expires with the session so a stale token is never sent
+				cookies.set('sessionToken', token, {
+					path: '/',
+					expires: new Date(data.expiresAt),
+					httpOnly: true,
+					secure: false,
+					sameSite: 'lax'
+				});
 			} else {
-				console.error('No userId returned from API');
+				console.error('No session returned from API');
 			}
 		} catch (error) {
 			console.error('Error creating user:', error);
@@ -77,6 +89,7 @@ export const load: LayoutServerLoad = async ({ cookies }) => {
 		username,
 		avatarId,
 		userId,
+		token,
 		themeClass,
 		backendAvailable: Boolean(backendAvailable)
 	};